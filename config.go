@@ -0,0 +1,573 @@
+package main
+
+import (
+  "os"
+  "fmt"
+  "math"
+  "sort"
+  "time"
+  "errors"
+  json "encoding/json"
+)
+
+//  kinds of managed service
+const (
+    serviceToggle = "toggle"  //  on/off, runs command with a trailing start or stop
+    serviceCI     = "ci"      //  runs command (or action) every interval while enabled
+)
+
+/*
+**  relayConfig - contents of the -config file
+*/
+type relayConfig struct {
+    Monitor     monitorConfig       `json:"monitor"`
+    Services    []serviceConfig     `json:"services"`
+}
+
+/*
+**  monitorConfig - how the link is watched
+**    Interval - seconds between polls, 5 if not set
+**    Sources  - where the link state comes from, in priority order.  ZI
+**               at -uri if not set
+**    Rule     - rulePriority (the default), ruleAll or ruleMajority
+**    Debounce - how long a new link state has to be seen before it is
+**               published, for transitions up to a better link and down
+*/
+type monitorConfig struct {
+    Interval    int             `json:"interval"`
+    Sources     []sourceConfig  `json:"sources,omitempty"`
+    Rule        string          `json:"rule,omitempty"`
+    Debounce    debounceConfig  `json:"debounce"`
+}
+
+/*
+**  sourceConfig - one LinkSource
+**    Type       - sourceZI, sourceFile, sourceCommand or sourceRoute
+**    Name       - for logs, defaults to Type
+**    URI        - zi, defaults to -uri
+**    Path       - file to read.  route, defaults to /proc/net/route
+**    MaxAge     - file, seconds before an unchanged file is an error
+**    Command    - command, argv to run
+**    ExitCodes  - command, link state for each exit code
+**    Interfaces - route, link state for each default route interface
+*/
+type sourceConfig struct {
+    Type        string                  `json:"type"`
+    Name        string                  `json:"name,omitempty"`
+    URI         string                  `json:"uri,omitempty"`
+    Path        string                  `json:"path,omitempty"`
+    MaxAge      int                     `json:"maxAge,omitempty"`
+    Command     []string                `json:"command,omitempty"`
+    ExitCodes   map[int] linkState      `json:"exitCodes,omitempty"`
+    Interfaces  map[string] linkState   `json:"interfaces,omitempty"`
+}
+
+type debounceConfig struct {
+    Up      debounceThreshold   `json:"up"`
+    Down    debounceThreshold   `json:"down"`
+}
+
+/*
+**  debounceThreshold - consecutive Polls or Seconds a state has to be seen
+**                      for, whichever comes first.  zero for either is off
+*/
+type debounceThreshold struct {
+    Polls       int     `json:"polls,omitempty"`
+    Seconds     int     `json:"seconds,omitempty"`
+}
+
+/*
+**  serviceConfig - one managed service
+**    Kind      - serviceToggle or serviceCI
+**    Command   - argv to execute.  toggle services get start/stop appended
+**    Action    - ci only, name of a builtin action to run instead of Command
+**    Interval  - seconds to sleep between runs
+**    EnabledOn - link states the service is turned on / allowed to run for
+**    RequireConnected    - optional, device types ZI has to report at least
+**                          one connected device for
+**    PauseOnUserOverride - turn the service off while a user has overridden ZI
+**    FailSafe  - optional, what to do when the link is unknown.  without it
+**                unknown is treated like any other link state
+**    Timeout   - optional, seconds a run can take before it is killed
+**    KillGrace - seconds between SIGTERM and SIGKILL when a run is killed,
+**                defaultKillGrace if not set
+**    Retry     - optional, how to back off after failed runs.  without it
+**                a failed run is retried after interval
+**    Backend   - toggle only, where the shovel's state is read from,
+**                shovelInitScript if not set, shovelStartStop to not read it
+**    Shovel    - the shovel's name, for shovelRabbitmqctl and
+**                shovelManagementAPI
+**    Shovels   - toggle only, several shovels managed together instead of
+**                the one named by Shovel
+**    Management - the management api, for shovelManagementAPI
+**    Reconcile - toggle only, seconds between checks of a shovel already
+**                as wanted, defaultReconcile if not set
+*/
+type serviceConfig struct {
+    Name        string      `json:"name"`
+    Kind        string      `json:"kind"`
+    Command     []string    `json:"command,omitempty"`
+    Action      string      `json:"action,omitempty"`
+    Interval    int         `json:"interval"`
+    EnabledOn   []linkState `json:"enabledOn"`
+    RequireConnected    []string    `json:"requireConnected,omitempty"`
+    PauseOnUserOverride bool        `json:"pauseOnUserOverride,omitempty"`
+    FailSafe    *failSafeConfig `json:"failSafe,omitempty"`
+    Timeout     int         `json:"timeout,omitempty"`
+    KillGrace   int         `json:"killGrace,omitempty"`
+    Retry       *retryConfig    `json:"retry,omitempty"`
+    Backend     string      `json:"backend,omitempty"`
+    Shovel      string      `json:"shovel,omitempty"`
+    Management  *managementConfig   `json:"management,omitempty"`
+    Shovels     []shovelConfig  `json:"shovels,omitempty"`
+    Reconcile   int         `json:"reconcile,omitempty"`
+}
+
+//  seconds a killed command gets to exit after SIGTERM if killGrace isn't set
+const defaultKillGrace = 10
+
+/*
+**  killGrace - how long a killed run gets between SIGTERM and SIGKILL
+*/
+func (s *serviceConfig) killGrace() time.Duration {
+    if s.KillGrace == 0 {
+        return defaultKillGrace * time.Second
+    }
+    return time.Duration(s.KillGrace) * time.Second
+}
+
+/*
+**  shovelConfig - one of a toggle service's shovels
+**    Name       - the shovel's name.  the service's init script gets it
+**                 before start, stop or status
+**    EnabledOn  - link states the shovel runs on, the service's if not set
+**    Priority   - higher priority shovels are started first and stopped
+**                 last
+**    Command    - optional, an init script for this shovel alone
+**    Definition - shovelManagementAPI, the value of the shovel's parameter
+**    Queue      - optional, lets the depth of the queue it ships from
+**                 override the link
+*/
+type shovelConfig struct {
+    Name        string          `json:"name"`
+    EnabledOn   []linkState     `json:"enabledOn,omitempty"`
+    Priority    int             `json:"priority,omitempty"`
+    Command     []string        `json:"command,omitempty"`
+    Definition  json.RawMessage `json:"definition,omitempty"`
+    Queue       *queuePolicy    `json:"queue,omitempty"`
+}
+
+/*
+**  queuePolicy - a shovel's queue depth thresholds.  the depth is read
+**                from the management api for shovelManagementAPI, from
+**                rabbitmqctl list_queues otherwise
+**    Name       - the local queue the shovel ships from
+**    SkipBelow  - the shovel isn't started on its enabledOn links with
+**                 fewer messages than this queued
+**    StartAbove - the shovel is also started on the AlsoOn links with
+**                 more than this queued, and runs there until the queue
+**                 is down to SkipBelow
+**    AlsoOn     - the more expensive links a backlog can start it on
+**    Interval   - seconds between depth reads, defaultQueueInterval if
+**                 not set
+*/
+type queuePolicy struct {
+    Name        string      `json:"name"`
+    SkipBelow   int         `json:"skipBelow,omitempty"`
+    StartAbove  int         `json:"startAbove,omitempty"`
+    AlsoOn      []linkState `json:"alsoOn,omitempty"`
+    Interval    int         `json:"interval,omitempty"`
+}
+
+//  seconds between queue depth reads if a queue policy's interval isn't set
+const defaultQueueInterval = 60
+
+/*
+**  shovels - the service's shovels, highest priority first.  a service
+**            without Shovels has the one, named Shovel or after itself
+*/
+func (s *serviceConfig) shovels() []shovelConfig {
+    if len(s.Shovels) == 0 {
+        shovel := shovelConfig{Name: s.Shovel, EnabledOn: s.EnabledOn, Command: s.Command}
+        if shovel.Name == "" {
+            shovel.Name = s.Name
+        }
+        if s.Management != nil {
+            shovel.Definition = s.Management.Definition
+        }
+        return []shovelConfig{shovel}
+    }
+
+    shovels := make([]shovelConfig, 0, len(s.Shovels))
+    for _, shovel := range s.Shovels {
+        if shovel.EnabledOn == nil {
+            shovel.EnabledOn = s.EnabledOn
+        }
+        if shovel.Command == nil && len(s.Command) > 0 {
+            shovel.Command = append(append([]string{}, s.Command...), shovel.Name)
+        }
+        shovels = append(shovels, shovel)
+    }
+    sort.SliceStable(shovels, func(i, j int) bool { return shovels[i].Priority > shovels[j].Priority })
+    return shovels
+}
+
+/*
+**  decideShovel - decide, for shovel's link states
+*/
+func (s *serviceConfig) decideShovel(shovel shovelConfig, status linkStatus) bool {
+    per := *s
+    per.EnabledOn = shovel.EnabledOn
+    return per.decide(status)
+}
+
+/*
+**  active - decide, or for a toggle service whether any of its shovels
+**           is wanted running
+*/
+func (s *serviceConfig) active(status linkStatus) bool {
+    if s.Kind != serviceToggle {
+        return s.decide(status)
+    }
+    for _, shovel := range s.shovels() {
+        if s.decideShovel(shovel, status) {
+            return true
+        }
+    }
+    return false
+}
+
+/*
+**  retryConfig - a service's backoff on consecutive failed runs.  the
+**                wait after n failures is initial * multiplier^(n-1),
+**                capped at max, less a random fraction of up to jitter
+**    Initial     - seconds to wait after the first failure, interval if
+**                  not set
+**    Max         - cap on the wait in seconds, defaultRetryMax if not set
+**    Multiplier  - growth per failure, defaultRetryMultiplier if not set
+**    Jitter      - 0 to 1, defaultRetryJitter if not set
+**    GiveUpAfter - optional, consecutive failures after which the service
+**                  is marked failed and stops running until the link changes
+*/
+type retryConfig struct {
+    Initial     int     `json:"initial,omitempty"`
+    Max         int     `json:"max,omitempty"`
+    Multiplier  float64 `json:"multiplier,omitempty"`
+    Jitter      float64 `json:"jitter,omitempty"`
+    GiveUpAfter int     `json:"giveUpAfter,omitempty"`
+}
+
+//  retry defaults
+const (
+    defaultRetryMax         = 3600
+    defaultRetryMultiplier  = 2
+    defaultRetryJitter      = 0.2
+)
+
+/*
+**  backoff - the wait after failures consecutive failures for a service
+**            running every interval seconds.  random, 0 to 1, picks the
+**            jitter
+*/
+func (r *retryConfig) backoff(interval, failures int, random float64) time.Duration {
+    initial, max, multiplier, jitter := float64(interval), float64(defaultRetryMax), float64(defaultRetryMultiplier), defaultRetryJitter
+    if r.Initial > 0 {
+        initial = float64(r.Initial)
+    }
+    if r.Max > 0 {
+        max = float64(r.Max)
+    }
+    if r.Multiplier > 0 {
+        multiplier = r.Multiplier
+    }
+    if r.Jitter > 0 {
+        jitter = r.Jitter
+    }
+
+    wait := math.Min(initial * math.Pow(multiplier, float64(failures - 1)), max)
+    wait -= wait * jitter * random
+    return time.Duration(wait * float64(time.Second))
+}
+
+/*
+**  failSafeConfig - a service's policy for an unreachable ZI
+**    StaleAfter - seconds the link can be unknown before Policy applies.
+**                 until then the last known link is acted on
+**    Policy     - failSafeHold, failSafeOff or failSafeOn
+*/
+type failSafeConfig struct {
+    StaleAfter  int     `json:"staleAfter"`
+    Policy      string  `json:"policy"`
+}
+
+//  what a service does once the link has been unknown for too long
+const (
+    failSafeHold = "hold"  //  keep acting on the last known link
+    failSafeOff  = "off"
+    failSafeOn   = "on"
+)
+
+//  how the answers from several link sources are combined
+const (
+    rulePriority = "priority"
+    ruleAll      = "all"
+    ruleMajority = "majority"
+)
+
+//  builtin ci actions that can be named instead of a command
+var ciActions = map[string] ciAction{
+    "promote-to-ship": fetchCIArtifacts,
+}
+
+/*
+**  defaultConfig - the services zi-relay managed before it had a config file
+*/
+func defaultConfig() *relayConfig {
+    return &relayConfig{
+        Monitor: monitorConfig{Interval: 5, Rule: rulePriority},
+        Services: []serviceConfig{
+            {
+                Name:       "shovel",
+                Kind:       serviceToggle,
+                Command:    []string{"/etc/init.d/rabbitmq-stopable-shovel"},
+                Interval:   5,
+                EnabledOn:  []linkState{linkBATS},
+                Backend:    shovelStartStop,
+            },
+            {
+                Name:       "chef-client",
+                Kind:       serviceCI,
+                Command:    []string{"chef-client"},
+                Interval:   5,
+                EnabledOn:  []linkState{linkBATS},
+            },
+            {
+                //  pause for 25 minutes between runs (25 * 60 = 1500 seconds)
+                Name:       "promote-to-ship",
+                Kind:       serviceCI,
+                Action:     "promote-to-ship",
+                Interval:   1500,
+                EnabledOn:  []linkState{linkBATS},
+            },
+        },
+    }
+}
+
+/*
+**  loadConfig - read and validate the config file at path.  an empty path
+**               gives the default config
+*/
+func loadConfig(path string) (cfg *relayConfig, err error) {
+    if path == "" {
+        return defaultConfig(), nil
+    }
+
+    file, err := os.Open(path)
+    if err != nil {
+        return nil, err
+    }
+    defer file.Close()
+
+    cfg = &relayConfig{}
+    decoder := json.NewDecoder(file)
+    decoder.DisallowUnknownFields()
+    err = decoder.Decode(cfg)
+    if err != nil {
+        return nil, fmt.Errorf("failed to parse config %s: %s", path, err)
+    }
+
+    if cfg.Monitor.Interval == 0 {
+        cfg.Monitor.Interval = 5
+    }
+    if cfg.Monitor.Rule == "" {
+        cfg.Monitor.Rule = rulePriority
+    }
+    err = cfg.validate()
+    if err != nil {
+        return nil, fmt.Errorf("invalid config %s: %s", path, err)
+    }
+    return cfg, nil
+}
+
+/*
+**  validate - check the monitor settings and that every service is complete
+**             and uniquely named
+*/
+func (c *relayConfig) validate() error {
+    debounce := c.Monitor.Debounce
+    if c.Monitor.Interval <= 0 {
+        return errors.New("monitor interval must be a positive number of seconds")
+    } else if debounce.Up.Polls < 0 || debounce.Up.Seconds < 0 || debounce.Down.Polls < 0 || debounce.Down.Seconds < 0 {
+        return errors.New("monitor debounce thresholds can not be negative")
+    }
+    switch c.Monitor.Rule {
+    case rulePriority, ruleAll, ruleMajority:
+    default:
+        return errors.New("unknown monitor rule '" + c.Monitor.Rule + "'")
+    }
+    for _, source := range c.Monitor.Sources {
+        _, err := newLinkSource(source, "")
+        if err != nil {
+            return fmt.Errorf("monitor source %s: %s", source.Name, err)
+        }
+    }
+
+    if len(c.Services) == 0 {
+        return errors.New("no services configured")
+    }
+    names := make(map[string] bool, len(c.Services))
+    for _, svc := range c.Services {
+        if svc.Name == "" {
+            return errors.New("service with no name")
+        } else if names[svc.Name] {
+            return errors.New("service " + svc.Name + " is configured more than once")
+        }
+        names[svc.Name] = true
+
+        err := svc.validate()
+        if err != nil {
+            return fmt.Errorf("service %s: %s", svc.Name, err)
+        }
+    }
+    return nil
+}
+
+/*
+**  validateShovels - checks a toggle service's backend has what it needs
+**                    for each of its shovels
+*/
+func (s *serviceConfig) validateShovels() error {
+    if s.Shovel != "" && len(s.Shovels) > 0 {
+        return errors.New("shovel and shovels can not both be set")
+    } else if len(s.Shovels) == 0 && s.Shovel == "" && (s.Backend == shovelRabbitmqctl || s.Backend == shovelManagementAPI) {
+        return errors.New("the " + s.Backend + " backend needs a shovel name")
+    }
+    names := make(map[string] bool)
+    for _, shovel := range s.shovels() {
+        if shovel.Name == "" {
+            return errors.New("every shovel needs a name")
+        } else if names[shovel.Name] {
+            return errors.New("shovel " + shovel.Name + " is configured more than once")
+        }
+        names[shovel.Name] = true
+
+        if q := shovel.Queue; q != nil {
+            if q.Name == "" {
+                return errors.New("shovel " + shovel.Name + " queue needs a name")
+            } else if q.SkipBelow < 0 || q.StartAbove < 0 || q.Interval < 0 {
+                return errors.New("shovel " + shovel.Name + " queue thresholds and interval can not be negative")
+            } else if (q.StartAbove > 0) != (len(q.AlsoOn) > 0) {
+                return errors.New("shovel " + shovel.Name + " queue startAbove and alsoOn go together")
+            } else if q.StartAbove > 0 && q.SkipBelow > q.StartAbove {
+                return errors.New("shovel " + shovel.Name + " queue skipBelow can not be above startAbove")
+            }
+        }
+
+        switch s.Backend {
+        case "", shovelInitScript, shovelRabbitmqctl, shovelStartStop:
+            if len(shovel.Command) == 0 {
+                return errors.New("toggle services need a command")
+            }
+        case shovelManagementAPI:
+            if s.Management == nil || len(shovel.Definition) == 0 {
+                return errors.New("the management backend needs management settings and a definition for every shovel")
+            } else if len(shovel.Command) != 0 {
+                return errors.New("the management backend takes no command")
+            }
+        default:
+            return errors.New("unknown backend '" + s.Backend + "'")
+        }
+    }
+    return nil
+}
+
+func (s *serviceConfig) validate() error {
+    switch s.Kind {
+    case serviceToggle:
+        err := s.validateShovels()
+        if err != nil {
+            return err
+        }
+        if s.Reconcile < 0 {
+            return errors.New("reconcile can not be negative")
+        } else if s.Action != "" {
+            return errors.New("toggle services can not have an action")
+        }
+    case serviceCI:
+        if len(s.Command) == 0 && s.Action == "" {
+            return errors.New("ci services need a command or an action")
+        } else if len(s.Command) != 0 && s.Action != "" {
+            return errors.New("ci services take a command or an action, not both")
+        } else if _, ok := ciActions[s.Action]; s.Action != "" && !ok {
+            return errors.New("unknown action " + s.Action)
+        } else if s.Backend != "" || s.Shovel != "" || s.Management != nil || s.Shovels != nil || s.Reconcile != 0 {
+            return errors.New("backend, shovel, shovels, management and reconcile are for toggle services")
+        }
+    default:
+        return errors.New("unknown kind '" + s.Kind + "'")
+    }
+
+    if s.Interval <= 0 {
+        return errors.New("interval must be a positive number of seconds")
+    }
+    if s.Timeout < 0 || s.KillGrace < 0 {
+        return errors.New("timeout and killGrace can not be negative")
+    }
+    if r := s.Retry; r != nil {
+        if r.Initial < 0 || r.Max < 0 || r.GiveUpAfter < 0 {
+            return errors.New("retry initial, max and giveUpAfter can not be negative")
+        } else if r.Multiplier != 0 && r.Multiplier < 1 {
+            return errors.New("retry multiplier must be at least 1")
+        } else if r.Jitter < 0 || r.Jitter > 1 {
+            return errors.New("retry jitter must be between 0 and 1")
+        }
+    }
+    if s.FailSafe != nil {
+        if s.FailSafe.StaleAfter < 0 {
+            return errors.New("failSafe staleAfter can not be negative")
+        }
+        switch s.FailSafe.Policy {
+        case failSafeHold, failSafeOff, failSafeOn:
+        default:
+            return errors.New("unknown failSafe policy '" + s.FailSafe.Policy + "'")
+        }
+    }
+    return nil
+}
+
+/*
+**  enabled - is this service turned on for the current link state and the
+**            state of the devices ZI reports
+*/
+func (s *serviceConfig) enabled(status linkStatus) bool {
+    if s.PauseOnUserOverride && status.ZI.UserOverride {
+        return false
+    }
+    for _, deviceType := range s.RequireConnected {
+        if !status.ZI.connected(deviceType) {
+            return false
+        }
+    }
+
+    for _, on := range s.EnabledOn {
+        if on == status.State {
+            return true
+        }
+    }
+    return false
+}
+
+/*
+**  decide - enabled, with the fail safe policy applied to an unknown link
+*/
+func (s *serviceConfig) decide(status linkStatus) bool {
+    if status.State != linkUnknown || s.FailSafe == nil {
+        return s.enabled(status)
+    }
+
+    staleAfter := time.Duration(s.FailSafe.StaleAfter) * time.Second
+    if s.FailSafe.Policy == failSafeHold || status.staleFor() < staleAfter {
+        return s.enabled(status.lastKnown())
+    }
+    return s.FailSafe.Policy == failSafeOn
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+    ioutil "io/ioutil"
+    "testing"
+    "time"
+    "os"
+)
+
+func writeConfig(body string, t *testing.T) string {
+    file, err := ioutil.TempFile("", "zi-relay-config")
+    if err != nil {
+        t.Fatalf("could not create config file: %s", err)
+    }
+    file.WriteString(body)
+    file.Close()
+    return file.Name()
+}
+
+func TestDefaultConfig(t *testing.T) {
+    cfg, err := loadConfig("")
+    if err != nil {
+        t.Fatalf("default config failed to load with: %s", err)
+    }
+
+    err = cfg.validate()
+    if err != nil {
+        t.Errorf("default config is not valid: %s", err)
+    }
+    if len(cfg.Services) != 3 {
+        t.Errorf("Expected the shovel, chef and promote services, got %d services", len(cfg.Services))
+    }
+}
+
+func TestExampleConfig(t *testing.T) {
+    cfg, err := loadConfig("zi-relay.example.json")
+    if err != nil {
+        t.Fatalf("example config failed to load with: %s", err)
+    }
+
+    shovel := cfg.Services[0]
+    if shovel.Name != "shovel" || shovel.Backend != shovelStartStop {
+        t.Errorf("Expected the example shovel to use the startstop backend like the default, got %+v", shovel)
+    }
+}
+
+func TestLoadConfig(t *testing.T) {
+    path := writeConfig(`{"services": [
+        {"name": "shovel", "kind": "toggle", "command": ["./sleep-short.sh"], "interval": 5, "enabledOn": ["bats"]},
+        {"name": "logs", "kind": "ci", "command": ["./sleep-short.sh", "now"], "interval": 60, "enabledOn": ["bats", "vsat"]}
+    ]}`, t)
+    defer os.Remove(path)
+
+    cfg, err := loadConfig(path)
+    if err != nil {
+        t.Fatalf("config failed to load with: %s", err)
+    }
+
+    logs := cfg.Services[1]
+    if logs.Name != "logs" || logs.Interval != 60 || len(logs.Command) != 2 {
+        t.Errorf("logs service not decoded correctly: %+v", logs)
+    }
+    if logs.enabled(linkStatus{State: linkBATS}) && logs.enabled(linkStatus{State: linkVSAT}) {
+        t.Log("logs service is enabled on both links")
+    } else {
+        t.Error("logs service should be enabled on both links")
+    }
+    if cfg.Services[0].enabled(linkStatus{State: linkVSAT}) {
+        t.Error("shovel service should not be enabled on vsat")
+    }
+}
+
+func TestServiceEnabledOnDevices(t *testing.T) {
+    svc := serviceConfig{Name: "a", EnabledOn: []linkState{linkBATS}, RequireConnected: []string{"BATS"}, PauseOnUserOverride: true}
+    bats := linkStatus{State: linkBATS, ZI: ziStatus{UsingBats: true, ConnObjectList: []ziConnection{{DeviceType: "BATS", DeviceName: "10.151.1.151", Connected: true}}}}
+
+    if !svc.enabled(bats) {
+        t.Error("service should be enabled with a connected BATS device")
+    }
+
+    disconnected := bats
+    disconnected.ZI.ConnObjectList = []ziConnection{{DeviceType: "BATS", DeviceName: "10.151.1.151", Connected: false}}
+    if svc.enabled(disconnected) {
+        t.Error("service should be disabled without a connected BATS device")
+    }
+
+    override := bats
+    override.ZI.UserOverride = true
+    if svc.enabled(override) {
+        t.Error("service should be paused while the user overrides ZI")
+    }
+}
+
+func TestServiceDecideFailSafe(t *testing.T) {
+    bats := linkStatus{State: linkBATS, Known: linkBATS, LastGood: time.Now()}
+    fresh := bats
+    fresh.State = linkUnknown
+    stale := fresh
+    stale.LastGood = time.Now().Add(-10 * time.Minute)
+
+    policies := []struct {
+        policy      string
+        fresh       bool
+        stale       bool
+    }{
+        {failSafeHold, true, true},
+        {failSafeOff, true, false},
+        {failSafeOn, true, true},
+    }
+    for _, p := range policies {
+        svc := serviceConfig{Name: "a", EnabledOn: []linkState{linkBATS}, FailSafe: &failSafeConfig{StaleAfter: 300, Policy: p.policy}}
+        if svc.decide(fresh) != p.fresh {
+            t.Errorf("%s: expected %t before the status went stale", p.policy, p.fresh)
+        }
+        if svc.decide(stale) != p.stale {
+            t.Errorf("%s: expected %t once the status went stale", p.policy, p.stale)
+        }
+    }
+
+    //  forcing on applies even if the last known link was off
+    vsat := stale
+    vsat.Known = linkVSAT
+    svc := serviceConfig{Name: "a", EnabledOn: []linkState{linkBATS}, FailSafe: &failSafeConfig{StaleAfter: 300, Policy: failSafeOn}}
+    if !svc.decide(vsat) {
+        t.Error("on policy should enable the service once stale")
+    }
+
+    //  without a policy unknown is just another link state
+    svc.FailSafe = nil
+    if svc.decide(fresh) {
+        t.Error("service without a fail safe should be off on unknown")
+    }
+}
+
+func TestLoadConfigInvalid(t *testing.T) {
+    bad := map[string] string{
+        "duplicate name":   `{"services": [{"name": "a", "kind": "ci", "command": ["x"], "interval": 5}, {"name": "a", "kind": "ci", "command": ["x"], "interval": 5}]}`,
+        "unknown kind":     `{"services": [{"name": "a", "kind": "sometimes", "command": ["x"], "interval": 5}]}`,
+        "no command":       `{"services": [{"name": "a", "kind": "toggle", "interval": 5}]}`,
+        "unknown action":   `{"services": [{"name": "a", "kind": "ci", "action": "deploy", "interval": 5}]}`,
+        "no interval":      `{"services": [{"name": "a", "kind": "ci", "command": ["x"]}]}`,
+        "unknown link":     `{"services": [{"name": "a", "kind": "ci", "command": ["x"], "interval": 5, "enabledOn": ["wifi"]}]}`,
+        "unknown field":    `{"services": [{"name": "a", "kind": "ci", "command": ["x"], "interval": 5, "sleep": 5}]}`,
+        "no services":      `{"services": []}`,
+        "unknown source":   `{"monitor": {"sources": [{"type": "wifi"}]}, "services": [{"name": "a", "kind": "ci", "command": ["x"], "interval": 5}]}`,
+        "unknown rule":     `{"monitor": {"rule": "loudest"}, "services": [{"name": "a", "kind": "ci", "command": ["x"], "interval": 5}]}`,
+        "negative timeout":     `{"services": [{"name": "a", "kind": "ci", "command": ["x"], "interval": 5, "timeout": -1}]}`,
+        "retry multiplier":     `{"services": [{"name": "a", "kind": "ci", "command": ["x"], "interval": 5, "retry": {"multiplier": 0.5}}]}`,
+        "retry jitter":         `{"services": [{"name": "a", "kind": "ci", "command": ["x"], "interval": 5, "retry": {"jitter": 2}}]}`,
+        "unknown backend":      `{"services": [{"name": "a", "kind": "toggle", "command": ["x"], "interval": 5, "backend": "telnet"}]}`,
+        "unnamed shovel":       `{"services": [{"name": "a", "kind": "toggle", "command": ["x"], "interval": 5, "backend": "rabbitmqctl"}]}`,
+        "no definition":        `{"services": [{"name": "a", "kind": "toggle", "interval": 5, "backend": "management", "shovel": "s", "management": {"vhost": "/"}}]}`,
+        "management command":   `{"services": [{"name": "a", "kind": "toggle", "command": ["x"], "interval": 5, "backend": "management", "shovel": "s", "management": {"definition": {}}}]}`,
+        "duplicate shovel":     `{"services": [{"name": "a", "kind": "toggle", "command": ["x"], "interval": 5, "shovels": [{"name": "s"}, {"name": "s"}]}]}`,
+        "shovel and shovels":   `{"services": [{"name": "a", "kind": "toggle", "command": ["x"], "interval": 5, "shovel": "s", "shovels": [{"name": "t"}]}]}`,
+        "unnamed queue":        `{"services": [{"name": "a", "kind": "toggle", "command": ["x"], "interval": 5, "shovels": [{"name": "s", "queue": {"skipBelow": 10}}]}]}`,
+        "backlog without links": `{"services": [{"name": "a", "kind": "toggle", "command": ["x"], "interval": 5, "shovels": [{"name": "s", "queue": {"name": "q", "startAbove": 10}}]}]}`,
+        "negative debounce":    `{"monitor": {"debounce": {"up": {"polls": -1}}}, "services": [{"name": "a", "kind": "ci", "command": ["x"], "interval": 5}]}`,
+        "unknown policy":   `{"services": [{"name": "a", "kind": "ci", "command": ["x"], "interval": 5, "failSafe": {"staleAfter": 60, "policy": "maybe"}}]}`,
+    }
+
+    for name, body := range bad {
+        path := writeConfig(body, t)
+        _, err := loadConfig(path)
+        os.Remove(path)
+        if err != nil {
+            t.Logf("%s correctly failed with: %s", name, err)
+        } else {
+            t.Errorf("%s config loaded when it should have failed", name)
+        }
+    }
+}
+
+func TestRetryBackoff(t *testing.T) {
+    retry := retryConfig{Max: 60}
+    for _, c := range []struct {
+        failures    int
+        random      float64
+        expected    time.Duration
+    }{
+        {1, 0, 5 * time.Second},
+        {2, 0, 10 * time.Second},
+        {4, 0, 40 * time.Second},
+        {5, 0, 60 * time.Second},
+        {30, 0, 60 * time.Second},
+        {2, 1, 8 * time.Second},
+        {30, 0.5, 54 * time.Second},
+    } {
+        if backoff := retry.backoff(5, c.failures, c.random); backoff != c.expected {
+            t.Errorf("After %d failures with random %g expected %s, got %s", c.failures, c.random, c.expected, backoff)
+        }
+    }
+
+    retry = retryConfig{Initial: 30, Multiplier: 3, Jitter: 1}
+    if backoff := retry.backoff(5, 3, 0); backoff != 270 * time.Second {
+        t.Errorf("Expected initial 30 tripled twice, got %s", backoff)
+    }
+    if backoff := retry.backoff(5, 3, 0.5); backoff != 135 * time.Second {
+        t.Errorf("Expected full jitter to halve the wait, got %s", backoff)
+    }
+}
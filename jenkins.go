@@ -2,7 +2,9 @@ package main
 
 import (
   "time"
+  "context"
   "strconv"
+  "strings"
   "errors"
   json "encoding/json"
   http "net/http"
@@ -22,6 +24,7 @@ var (
 */
 type PromoteToShip struct {
     Shipcode    string
+    Result      string  //  the job's result once Wait has seen one
     started bool
     waited  bool
     olderr  error
@@ -53,13 +56,28 @@ type jobResult struct {
 **  Start - queues up the promote to ship job with this Shipcode on jenkins-ci
 */
 func (p *PromoteToShip) Start() (err error) {
+    return p.StartContext(context.Background())
+}
+
+/*
+**  StartContext - Start, abandoning the post if ctx is cancelled
+*/
+func (p *PromoteToShip) StartContext(ctx context.Context) (err error) {
     p.started = true
     p.waited = false  //  is default, but if we call posting twice against same jenkins reference
     //  post the job!
-    resp, err := http.PostForm(ciPostURL,url.Values{"SHIPNAME": {p.Shipcode}})
+    form := url.Values{"SHIPNAME": {p.Shipcode}}
+    req, err := http.NewRequestWithContext(ctx, "POST", ciPostURL, strings.NewReader(form.Encode()))
+    if err != nil {
+        return err
+    }
+    req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+    resp, err := http.DefaultClient.Do(req)
     if err != nil {
         return err
-    } else if resp.StatusCode != 201 && resp.StatusCode != 302 {
+    }
+    defer resp.Body.Close()
+    if resp.StatusCode != 201 && resp.StatusCode != 302 {
         dumpResponse, _ := httputil.DumpResponse(resp, true)
         return errors.New("Should have gotten a 201 or 302 from the job post, received a " + strconv.Itoa(resp.StatusCode) + " with a body of: " + string(dumpResponse))
     }
@@ -74,10 +92,15 @@ func (p *PromoteToShip) Start() (err error) {
 **         + has a result
 **           - result is a field in the json status
 **           - if there is a result, the job is done
-**
-**  TODO:  add a timeout so we don't loop forever
 */
 func (p *PromoteToShip) Wait(sleepSeconds int) (err error) {
+    return p.WaitContext(context.Background(), sleepSeconds)
+}
+
+/*
+**  WaitContext - Wait, giving up with ctx's error when ctx is cancelled
+*/
+func (p *PromoteToShip) WaitContext(ctx context.Context, sleepSeconds int) (err error) {
     defer func() {
         p.olderr = err
     }()
@@ -93,14 +116,7 @@ func (p *PromoteToShip) Wait(sleepSeconds int) (err error) {
     jobNotStarted := true
     var lastBuild lastBuildResponse
     for jobNotStarted {
-        resp, err := http.Get(ciLastBuild)
-        if err != nil {
-            return err
-        }
-
-        decoder := json.NewDecoder(resp.Body)
-        err = decoder.Decode(&lastBuild)
-        resp.Body.Close()
+        err := getJSON(ctx, ciLastBuild, &lastBuild)
         if err != nil {
             return err
         }
@@ -108,21 +124,16 @@ func (p *PromoteToShip) Wait(sleepSeconds int) (err error) {
         if lastBuild.LastBuild.Actions[0].Parameters[0].Value == p.Shipcode {
             jobNotStarted = false
         }
-        time.Sleep(time.Duration(sleepSeconds) * time.Second)
+        if err := sleepContext(ctx, sleepSeconds); err != nil {
+            return err
+        }
     }
 
     //  have the job, poll the job url until a result is present
     jobRunning := true
     var result jobResult
     for jobRunning {
-        resp, err := http.Get(lastBuild.LastBuild.Url + ciResult)
-        if err != nil {
-            return err
-        }
-
-        decoder := json.NewDecoder(resp.Body)
-        err = decoder.Decode(&result)
-        resp.Body.Close()
+        err := getJSON(ctx, lastBuild.LastBuild.Url + ciResult, &result)
         if err != nil {
             return err
         }
@@ -131,9 +142,12 @@ func (p *PromoteToShip) Wait(sleepSeconds int) (err error) {
             jobRunning = false
         }
 
-        time.Sleep(time.Duration(sleepSeconds) * time.Second)
+        if err := sleepContext(ctx, sleepSeconds); err != nil {
+            return err
+        }
     }
 
+    p.Result = result.Result.(string)
     if result.Result.(string) != "SUCCESS" {
         err = errors.New("Job did not succeed.  Result is: " + result.Result.(string))
     } else {
@@ -142,3 +156,37 @@ func (p *PromoteToShip) Wait(sleepSeconds int) (err error) {
 
     return err
 }
+
+/*
+**  getJSON - decodes the json at uri into v, the request is abandoned if
+**            ctx is cancelled
+*/
+func getJSON(ctx context.Context, uri string, v interface{}) error {
+    req, err := http.NewRequestWithContext(ctx, "GET", uri, nil)
+    if err != nil {
+        return err
+    }
+    resp, err := http.DefaultClient.Do(req)
+    if err != nil {
+        return err
+    }
+    defer resp.Body.Close()
+
+    decoder := json.NewDecoder(resp.Body)
+    return decoder.Decode(v)
+}
+
+/*
+**  sleepContext - sleeps for seconds, returning early with ctx's error if
+**                 ctx is cancelled
+*/
+func sleepContext(ctx context.Context, seconds int) error {
+    timer := time.NewTimer(time.Duration(seconds) * time.Second)
+    defer timer.Stop()
+    select {
+    case <-timer.C:
+        return nil
+    case <-ctx.Done():
+        return ctx.Err()
+    }
+}
@@ -4,7 +4,10 @@ import (
     "time"
     "fmt"
     "testing"
+    "context"
+    "errors"
     http "net/http"
+    httptest "net/http/httptest"
 )
 
 var (
@@ -55,7 +58,7 @@ func lastBuildHandle(w http.ResponseWriter, r *http.Request) {
         if !jobStarted {
             fmt.Fprintf(w, "{\"lastBuild\":{\"actions\":[{\"parameters\":[{\"name\":\"SHIPCODE\",\"value\":\"nachoShip\"}]},{}],\"url\":\"http://localhost:7005//\"}}")
         } else {
-            fmt.Fprintf(w, "{\"lastBuild\":{\"actions\":[{\"parameters\":[{\"name\":\"SHIPCODE\",\"value\":\"" + *shipcode + "\"}]},{}],\"url\":\"http://localhost:7005//\"}}")
+            fmt.Fprintf(w, "{\"lastBuild\":{\"actions\":[{\"parameters\":[{\"name\":\"SHIPCODE\",\"value\":\"%s\"}]},{}],\"url\":\"http://localhost:7005//\"}}", *shipcode)
         }
     }
 }
@@ -196,3 +199,51 @@ func TestWaitDoubleWait(t *testing.T){
         t.Errorf("Error changed.  Was:  %s, now is: %s", errOrig, errRecall)
     }
 }
+
+func TestWaitCancelled(t *testing.T) {
+    go dummyJenkins()
+
+    time.Sleep(time.Second)
+    ciLastBuild = "http://localhost:7005/lastBuild"
+
+    //  a ship code that never shows up as the last build
+    local := &PromoteToShip{Shipcode: "cancelledShip", started: true}
+    ctx, cancel := context.WithCancel(context.Background())
+    go func() {
+        time.Sleep(1500 * time.Millisecond)
+        cancel()
+    }()
+
+    start := time.Now()
+    err := local.WaitContext(ctx, 1)
+    if err != context.Canceled {
+        t.Errorf("Expected the cancelled wait to fail with %s, got %v", context.Canceled, err)
+    } else if time.Since(start) > 3 * time.Second {
+        t.Errorf("Cancelled wait took %s to return", time.Since(start))
+    }
+}
+
+func TestStartCancelled(t *testing.T) {
+    //  a jenkins that takes the post and never answers
+    release := make(chan struct{})
+    server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        <-release
+    }))
+    defer server.Close()
+    defer close(release)
+    saved := ciPostURL
+    ciPostURL = server.URL + "/promote"
+    defer func() { ciPostURL = saved }()
+
+    local := &PromoteToShip{Shipcode: "cancelledShip"}
+    ctx, cancel := context.WithTimeout(context.Background(), 500 * time.Millisecond)
+    defer cancel()
+
+    start := time.Now()
+    err := local.StartContext(ctx)
+    if !errors.Is(err, context.DeadlineExceeded) {
+        t.Errorf("Expected the cancelled post to fail with %s, got %v", context.DeadlineExceeded, err)
+    } else if time.Since(start) > 2 * time.Second {
+        t.Errorf("Cancelled post took %s to return", time.Since(start))
+    }
+}
@@ -0,0 +1,378 @@
+package main
+
+import (
+  "os"
+  "fmt"
+  "log/slog"
+  "time"
+  "bufio"
+  "bytes"
+  "errors"
+  "strconv"
+  "strings"
+  "context"
+  ioutil "io/ioutil"
+  json "encoding/json"
+  http "net/http"
+  exec "os/exec"
+)
+
+//  types of link source
+const (
+    sourceZI      = "zi"
+    sourceFile    = "file"
+    sourceCommand = "command"
+    sourceRoute   = "route"
+)
+
+/*
+**  LinkSource - anything that can tell which link the ship is routing
+**               through.  Poll returns the current state, with the ZI
+**               details filled in if the source has them, and gives up
+**               when ctx is cancelled
+*/
+type LinkSource interface {
+    Name() string
+    Poll(ctx context.Context) (linkStatus, error)
+}
+
+/*
+**  newLinkSource - builds the source described by cfg.  a zi source with
+**                  no uri uses defaultURI
+*/
+func newLinkSource(cfg sourceConfig, defaultURI string) (LinkSource, error) {
+    name := cfg.Name
+    if name == "" {
+        name = cfg.Type
+    }
+
+    switch cfg.Type {
+    case sourceZI:
+        uri := cfg.URI
+        if uri == "" {
+            uri = defaultURI
+        }
+        return &ziSource{name: name, uri: uri}, nil
+    case sourceFile:
+        if cfg.Path == "" {
+            return nil, errors.New("file sources need a path")
+        }
+        return &fileSource{name: name, path: cfg.Path, maxAge: time.Duration(cfg.MaxAge) * time.Second}, nil
+    case sourceCommand:
+        if len(cfg.Command) == 0 {
+            return nil, errors.New("command sources need a command")
+        }
+        return &commandSource{name: name, argv: cfg.Command, exitCodes: cfg.ExitCodes}, nil
+    case sourceRoute:
+        if len(cfg.Interfaces) == 0 {
+            return nil, errors.New("route sources need interfaces mapped to link states")
+        }
+        path := cfg.Path
+        if path == "" {
+            path = "/proc/net/route"
+        }
+        return &routeSource{name: name, path: path, interfaces: cfg.Interfaces}, nil
+    }
+    return nil, errors.New("unknown source type '" + cfg.Type + "'")
+}
+
+/*
+**  buildSources - the sources listed in the monitor config, or just ZI at
+**                 defaultURI if there are none
+*/
+func buildSources(cfg monitorConfig, defaultURI string) ([]LinkSource, error) {
+    if len(cfg.Sources) == 0 {
+        return []LinkSource{&ziSource{name: sourceZI, uri: defaultURI}}, nil
+    }
+
+    sources := make([]LinkSource, 0, len(cfg.Sources))
+    for _, sourceCfg := range cfg.Sources {
+        source, err := newLinkSource(sourceCfg, defaultURI)
+        if err != nil {
+            return nil, err
+        }
+        sources = append(sources, source)
+    }
+    return sources, nil
+}
+
+/*
+**  ziStatus - the ZeroImpact connectionStatus response
+*/
+type ziStatus struct {
+    ConnObjectList              []ziConnection  `json:"connObjectList"`
+    UsingBats                   bool            `json:"usingBATS"`
+    SecondsUntilUserCanInteract int             `json:"secondsUntilUserCanInteract"`
+    ConnectionExplanation       string          `json:"connectionExplanation"`
+    UserOverride                bool            `json:"userOverride"`
+}
+
+/*
+**  ziConnection - one link device ZI knows about
+*/
+type ziConnection struct {
+    DeviceType  string  `json:"deviceType"`
+    DeviceName  string  `json:"deviceName"`
+    Connected   bool    `json:"connected"`
+}
+
+/*
+**  connected - true if any device of deviceType reports connected
+*/
+func (z ziStatus) connected(deviceType string) bool {
+    for _, conn := range z.ConnObjectList {
+        if strings.EqualFold(conn.DeviceType, deviceType) && conn.Connected {
+            return true
+        }
+    }
+    return false
+}
+
+/*
+**  link - the link state ZI is reporting.  ZI only says whether it is using
+**         BATS, otherwise the first connected LTE or VSAT device wins and
+**         satellite is assumed when there is none
+*/
+func (z ziStatus) link() linkState {
+    if z.UsingBats {
+        return linkBATS
+    }
+    for _, conn := range z.ConnObjectList {
+        if !conn.Connected {
+            continue
+        }
+        state, err := parseLinkState(conn.DeviceType)
+        if err == nil && (state == linkLTE || state == linkVSAT) {
+            return state
+        }
+    }
+    return linkVSAT
+}
+
+/*
+**  ziSource - polls the ZeroImpact connectionStatus interface
+*/
+type ziSource struct {
+    name        string
+    uri         string
+    explanation string
+}
+
+//  longest a ZI poll can take before it is abandoned
+var ziSourceTimeout = 10 * time.Second
+
+func (z *ziSource) Name() string {
+    return z.name
+}
+
+func (z *ziSource) Poll(ctx context.Context) (status linkStatus, err error) {
+    start := time.Now()
+    defer func() {
+        metrics.ziPolled(time.Since(start), err)
+    }()
+
+    //  a ZI that accepts the connection but never answers is unknown, not
+    //  whatever it last said
+    ctx, cancel := context.WithTimeout(ctx, ziSourceTimeout)
+    defer cancel()
+    req, err := http.NewRequestWithContext(ctx, "GET", z.uri, nil)
+    if err != nil {
+        return status, err
+    }
+    resp, err := http.DefaultClient.Do(req)
+    if err != nil {
+        return status, fmt.Errorf("failed to access ZeroImpact service at %s with error %s", z.uri, err)
+    }
+    body, err := ioutil.ReadAll(resp.Body)
+    resp.Body.Close()
+    if err != nil {
+        return status, fmt.Errorf("failed to read zi response, %s", err)
+    } else if resp.StatusCode / 100 != 2 {
+        return status, fmt.Errorf("ZeroImpact service at %s answered %s", z.uri, resp.Status)
+    }
+
+    //  a body without usingBATS would decode to a zero status, vsat.  the
+    //  key is matched without case, as the decoding does
+    var fields map[string] json.RawMessage
+    err = json.Unmarshal(body, &fields)
+    if err == nil {
+        err = json.Unmarshal(body, &status.ZI)
+    }
+    if err != nil {
+        return linkStatus{}, fmt.Errorf("failed to decode zi response, %s", err)
+    }
+    usingBATS := false
+    for key := range fields {
+        usingBATS = usingBATS || strings.EqualFold(key, "usingBATS")
+    }
+    if !usingBATS {
+        return linkStatus{}, errors.New("zi response has no usingBATS")
+    }
+
+    status.State = status.ZI.link()
+    if status.ZI.ConnectionExplanation != z.explanation {
+        z.explanation = status.ZI.ConnectionExplanation
+        slog.Info("ZI status changed", "source", z.name, "using_bats", status.ZI.UsingBats, "user_override", status.ZI.UserOverride, "explanation", z.explanation)
+    }
+    return status, nil
+}
+
+/*
+**  fileSource - reads a link state name written to a file by other tooling.
+**               a file older than maxAge, if set, is an error
+*/
+type fileSource struct {
+    name    string
+    path    string
+    maxAge  time.Duration
+}
+
+func (f *fileSource) Name() string {
+    return f.name
+}
+
+func (f *fileSource) Poll(ctx context.Context) (status linkStatus, err error) {
+    file, err := os.Open(f.path)
+    if err != nil {
+        return status, err
+    }
+    defer file.Close()
+
+    if f.maxAge > 0 {
+        stat, err := file.Stat()
+        if err != nil {
+            return status, err
+        } else if age := time.Since(stat.ModTime()); age > f.maxAge {
+            return status, fmt.Errorf("%s is %s old", f.path, age.Round(time.Second))
+        }
+    }
+
+    contents, err := ioutil.ReadAll(file)
+    if err != nil {
+        return status, err
+    }
+    fields := strings.Fields(string(contents))
+    if len(fields) == 0 {
+        return status, errors.New(f.path + " is empty")
+    }
+    status.State, err = parseLinkState(fields[0])
+    return status, err
+}
+
+/*
+**  commandSource - runs a command.  the first word of stdout is used if it
+**                  is a link state, otherwise the exit code is looked up
+**                  in exitCodes
+*/
+type commandSource struct {
+    name        string
+    argv        []string
+    exitCodes   map[int] linkState
+}
+
+//  longest a command source can take before it is killed
+var commandSourceTimeout = 10 * time.Second
+
+func (c *commandSource) Name() string {
+    return c.name
+}
+
+func (c *commandSource) Poll(ctx context.Context) (status linkStatus, err error) {
+    ctx, cancel := context.WithTimeout(ctx, commandSourceTimeout)
+    defer cancel()
+
+    cmd := exec.CommandContext(ctx, c.argv[0], c.argv[1:]...)
+    var out bytes.Buffer
+    cmd.Stdout = &out
+    runErr := cmd.Run()
+
+    exitCode := 0
+    if exitErr, ok := runErr.(*exec.ExitError); ok {
+        exitCode = exitErr.ExitCode()
+    } else if runErr != nil {
+        return status, runErr
+    }
+
+    if fields := strings.Fields(out.String()); len(fields) > 0 {
+        status.State, err = parseLinkState(fields[0])
+        if err == nil {
+            return status, nil
+        }
+    }
+    state, ok := c.exitCodes[exitCode]
+    if !ok {
+        return status, fmt.Errorf("%s exited %d without printing a link state", c.argv[0], exitCode)
+    }
+    status.State = state
+    return status, nil
+}
+
+/*
+**  routeSource - maps the interface of the default route in the kernel
+**                routing table to a link state.  no default route means
+**                the ship is offline
+*/
+type routeSource struct {
+    name        string
+    path        string
+    interfaces  map[string] linkState
+}
+
+func (r *routeSource) Name() string {
+    return r.name
+}
+
+func (r *routeSource) Poll(ctx context.Context) (status linkStatus, err error) {
+    iface, err := defaultRouteInterface(r.path)
+    if err != nil {
+        return status, err
+    } else if iface == "" {
+        status.State = linkOffline
+        return status, nil
+    }
+
+    state, ok := r.interfaces[iface]
+    if !ok {
+        return status, errors.New("default route is through unmapped interface " + iface)
+    }
+    status.State = state
+    return status, nil
+}
+
+/*
+**  defaultRouteInterface - the interface of the lowest metric default
+**                          route in a /proc/net/route style table, empty
+**                          if there is none
+*/
+func defaultRouteInterface(path string) (string, error) {
+    file, err := os.Open(path)
+    if err != nil {
+        return "", err
+    }
+    defer file.Close()
+
+    iface := ""
+    bestMetric := -1
+    scanner := bufio.NewScanner(file)
+    scanner.Scan()  //  header
+    for scanner.Scan() {
+        //  Iface Destination Gateway Flags RefCnt Use Metric Mask ...
+        fields := strings.Fields(scanner.Text())
+        if len(fields) < 8 || fields[1] != "00000000" || fields[7] != "00000000" {
+            continue
+        }
+        flags, err := strconv.ParseUint(fields[3], 16, 32)
+        if err != nil || flags & 0x1 == 0 {
+            continue  //  route not up
+        }
+        metric, err := strconv.Atoi(fields[6])
+        if err != nil {
+            continue
+        }
+        if bestMetric < 0 || metric < bestMetric {
+            iface = fields[0]
+            bestMetric = metric
+        }
+    }
+    return iface, scanner.Err()
+}
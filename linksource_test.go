@@ -0,0 +1,145 @@
+package main
+
+import (
+    ioutil "io/ioutil"
+    "testing"
+    "time"
+    "os"
+    "context"
+)
+
+func TestZISource(t *testing.T) {
+    go dummyZI()
+    time.Sleep(1 * time.Second)
+
+    source, err := newLinkSource(sourceConfig{Type: sourceZI}, "http://localhost:7000/ZIOn")
+    if err != nil {
+        t.Fatalf("Failed to build zi source with: %s", err)
+    }
+    status, err := source.Poll(context.Background())
+    if err != nil {
+        t.Fatalf("zi source failed with: %s", err)
+    }
+    if status.State != linkBATS || status.ZI.ConnectionExplanation != "Ship in motion" {
+        t.Errorf("zi source returned %+v", status)
+    }
+
+    source, _ = newLinkSource(sourceConfig{Type: sourceZI, URI: "http://localhost:7000/nothing"}, "")
+    _, err = source.Poll(context.Background())
+    if err == nil {
+        t.Error("zi source should fail to decode a 404")
+    }
+
+    for _, uri := range []string{"http://localhost:7000/ZIBroken", "http://localhost:7000/ZIEmpty"} {
+        source, _ = newLinkSource(sourceConfig{Type: sourceZI, URI: uri}, "")
+        status, err = source.Poll(context.Background())
+        if err == nil {
+            t.Errorf("zi source should fail for %s, got %+v", uri, status)
+        }
+    }
+
+    source, _ = newLinkSource(sourceConfig{Type: sourceZI, URI: "http://localhost:7000/ZIOldCase"}, "")
+    status, err = source.Poll(context.Background())
+    if err != nil || status.State != linkBATS {
+        t.Errorf("zi source should accept usingBats, got %+v and %v", status, err)
+    }
+
+    defer func(old time.Duration) { ziSourceTimeout = old }(ziSourceTimeout)
+    ziSourceTimeout = 200 * time.Millisecond
+    source, _ = newLinkSource(sourceConfig{Type: sourceZI, URI: "http://localhost:7000/ZIHang"}, "")
+    start := time.Now()
+    _, err = source.Poll(context.Background())
+    if err == nil || time.Since(start) > 2 * time.Second {
+        t.Errorf("zi source should give up on a ZI that never answers, got %v after %s", err, time.Since(start))
+    }
+}
+
+func TestFileSource(t *testing.T) {
+    file, err := ioutil.TempFile("", "zi-relay-link")
+    if err != nil {
+        t.Fatalf("could not create link file: %s", err)
+    }
+    file.WriteString("LTE\n")
+    file.Close()
+    defer os.Remove(file.Name())
+
+    source, _ := newLinkSource(sourceConfig{Type: sourceFile, Path: file.Name(), MaxAge: 60}, "")
+    status, err := source.Poll(context.Background())
+    if err != nil || status.State != linkLTE {
+        t.Errorf("Expected lte from the link file, got %s, %v", status.State, err)
+    }
+
+    old := time.Now().Add(-2 * time.Minute)
+    os.Chtimes(file.Name(), old, old)
+    _, err = source.Poll(context.Background())
+    if err != nil {
+        t.Logf("Old link file correctly failed with: %s", err)
+    } else {
+        t.Error("A link file older than maxAge should be an error")
+    }
+}
+
+func TestCommandSource(t *testing.T) {
+    source, _ := newLinkSource(sourceConfig{Type: sourceCommand, Command: []string{"sh", "-c", "echo vsat"}}, "")
+    status, err := source.Poll(context.Background())
+    if err != nil || status.State != linkVSAT {
+        t.Errorf("Expected vsat from stdout, got %s, %v", status.State, err)
+    }
+
+    exitCodes := map[int] linkState{0: linkBATS, 3: linkOffline}
+    source, _ = newLinkSource(sourceConfig{Type: sourceCommand, Command: []string{"sh", "-c", "exit 3"}, ExitCodes: exitCodes}, "")
+    status, err = source.Poll(context.Background())
+    if err != nil || status.State != linkOffline {
+        t.Errorf("Expected offline from exit code 3, got %s, %v", status.State, err)
+    }
+
+    source, _ = newLinkSource(sourceConfig{Type: sourceCommand, Command: []string{"sh", "-c", "exit 4"}, ExitCodes: exitCodes}, "")
+    _, err = source.Poll(context.Background())
+    if err == nil {
+        t.Error("An unmapped exit code should be an error")
+    }
+}
+
+func TestRouteSource(t *testing.T) {
+    table := "Iface\tDestination\tGateway \tFlags\tRefCnt\tUse\tMetric\tMask\t\tMTU\tWindow\tIRTT\n" +
+        "wwan0\t00000000\t0101A8C0\t0003\t0\t0\t600\t00000000\t0\t0\t0\n" +
+        "eth1\t00000000\t01010A0A\t0003\t0\t0\t100\t00000000\t0\t0\t0\n" +
+        "eth0\t0001A8C0\t00000000\t0001\t0\t0\t0\t00FFFFFF\t0\t0\t0\n"
+    file, err := ioutil.TempFile("", "zi-relay-route")
+    if err != nil {
+        t.Fatalf("could not create route file: %s", err)
+    }
+    file.WriteString(table)
+    file.Close()
+    defer os.Remove(file.Name())
+
+    interfaces := map[string] linkState{"eth1": linkBATS, "wwan0": linkLTE}
+    source, _ := newLinkSource(sourceConfig{Type: sourceRoute, Path: file.Name(), Interfaces: interfaces}, "")
+    status, err := source.Poll(context.Background())
+    if err != nil || status.State != linkBATS {
+        t.Errorf("Expected bats from the lowest metric default route, got %s, %v", status.State, err)
+    }
+
+    ioutil.WriteFile(file.Name(), []byte("Iface\tDestination\tGateway \tFlags\tRefCnt\tUse\tMetric\tMask\t\tMTU\tWindow\tIRTT\n"), 0644)
+    status, err = source.Poll(context.Background())
+    if err != nil || status.State != linkOffline {
+        t.Errorf("Expected offline without a default route, got %s, %v", status.State, err)
+    }
+}
+
+func TestMonitorSourcePriority(t *testing.T) {
+    broken, _ := newLinkSource(sourceConfig{Type: sourceFile, Path: "/nonexistent/link"}, "")
+    lte, _ := newLinkSource(sourceConfig{Type: sourceCommand, Command: []string{"echo", "lte"}}, "")
+    m := newLinkMonitor([]LinkSource{broken, lte}, monitorConfig{Interval: 5}, nil)
+
+    status := m.poll(context.Background())
+    if status.State != linkLTE || status.Known != linkLTE {
+        t.Errorf("Expected the monitor to fall back to lte, got %+v", status)
+    }
+
+    m.configure([]LinkSource{broken}, monitorConfig{Interval: 5})
+    status = m.poll(context.Background())
+    if status.State != linkUnknown || status.Known != linkLTE {
+        t.Errorf("Expected unknown with lte last known, got %+v", status)
+    }
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+  "time"
+  "strings"
+  "errors"
+)
+
+/*
+**  linkState - which kind of link the ship is routing through.  ordered
+**              from worst to best so transitions can be called up or down
+*/
+type linkState int
+
+const (
+    linkUnknown linkState = iota  //  ZI could not be reached or decoded
+    linkOffline
+    linkVSAT
+    linkLTE
+    linkBATS
+)
+
+var linkStateNames = []string{"unknown", "offline", "vsat", "lte", "bats"}
+
+func (l linkState) String() string {
+    if l < 0 || int(l) >= len(linkStateNames) {
+        return linkStateNames[linkUnknown]
+    }
+    return linkStateNames[l]
+}
+
+/*
+**  parseLinkState - case insensitive lookup of a link state by name
+*/
+func parseLinkState(name string) (linkState, error) {
+    for state, stateName := range linkStateNames {
+        if strings.EqualFold(name, stateName) {
+            return linkState(state), nil
+        }
+    }
+    return linkUnknown, errors.New("unknown link state " + name)
+}
+
+func (l linkState) MarshalText() ([]byte, error) {
+    return []byte(l.String()), nil
+}
+
+func (l *linkState) UnmarshalText(text []byte) (err error) {
+    *l, err = parseLinkState(string(text))
+    return err
+}
+
+/*
+**  linkStatus - what the monitor publishes to every service
+**    State     - the link being routed through
+**    ZI        - the last ZI response decoded.  it is stale if State is unknown
+**    Known     - the last state that wasn't unknown
+**    LastGood  - when the state was last known, or the monitor started
+**    Override  - State was set by an operator, not the link sources
+*/
+type linkStatus struct {
+    State       linkState
+    ZI          ziStatus
+    Known       linkState
+    LastGood    time.Time
+    Override    bool
+}
+
+/*
+**  describe - the link state for logs, marked if it is an override
+*/
+func (l linkStatus) describe() string {
+    if l.Override {
+        return l.State.String() + " (override)"
+    }
+    return l.State.String()
+}
+
+/*
+**  staleFor - how long the link has been unknown
+*/
+func (l linkStatus) staleFor() time.Duration {
+    if l.State != linkUnknown {
+        return 0
+    }
+    return time.Since(l.LastGood)
+}
+
+/*
+**  lastKnown - the status as it was before the link became unknown
+*/
+func (l linkStatus) lastKnown() linkStatus {
+    known := l
+    known.State = l.Known
+    return known
+}
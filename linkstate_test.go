@@ -0,0 +1,64 @@
+package main
+
+import (
+    "testing"
+    json "encoding/json"
+)
+
+func TestParseLinkState(t *testing.T) {
+    for _, name := range linkStateNames {
+        state, err := parseLinkState(name)
+        if err != nil {
+            t.Errorf("Failed to parse %s with: %s", name, err)
+        } else if state.String() != name {
+            t.Errorf("Expected %s to round trip, got %s", name, state)
+        }
+    }
+
+    state, err := parseLinkState("BATS")
+    if err != nil || state != linkBATS {
+        t.Errorf("Link state names should be case insensitive, got %s, %s", state, err)
+    }
+
+    _, err = parseLinkState("wifi")
+    if err == nil {
+        t.Error("wifi should not be a link state")
+    }
+}
+
+func TestLinkStateJSON(t *testing.T) {
+    var states []linkState
+    err := json.Unmarshal([]byte(`["lte", "unknown", "VSAT"]`), &states)
+    if err != nil {
+        t.Fatalf("Failed to decode link states with: %s", err)
+    }
+    if len(states) != 3 || states[0] != linkLTE || states[1] != linkUnknown || states[2] != linkVSAT {
+        t.Errorf("Link states decoded incorrectly: %v", states)
+    }
+
+    out, _ := json.Marshal(states)
+    if string(out) != `["lte","unknown","vsat"]` {
+        t.Errorf("Link states encoded incorrectly: %s", out)
+    }
+}
+
+func TestZILink(t *testing.T) {
+    lte := ziConnection{DeviceType: "LTE", DeviceName: "wwan0", Connected: true}
+    bats := ziConnection{DeviceType: "BATS", DeviceName: "10.151.1.151", Connected: false}
+
+    cases := []struct {
+        status  ziStatus
+        link    linkState
+    }{
+        {ziStatus{UsingBats: true, ConnObjectList: []ziConnection{bats}}, linkBATS},
+        {ziStatus{UsingBats: false, ConnObjectList: []ziConnection{bats}}, linkVSAT},
+        {ziStatus{UsingBats: false, ConnObjectList: []ziConnection{bats, lte}}, linkLTE},
+        {ziStatus{}, linkVSAT},
+    }
+
+    for i, c := range cases {
+        if link := c.status.link(); link != c.link {
+            t.Errorf("case %d: expected %s, got %s", i, c.link, link)
+        }
+    }
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+  "io"
+  "os"
+  "errors"
+  "strings"
+  "log/slog"
+)
+
+//  log formats
+const (
+    logJSON     = "json"
+    logLogfmt   = "logfmt"
+)
+
+/*
+**  parseLogLevel - debug, info, warn or error
+*/
+func parseLogLevel(name string) (slog.Level, error) {
+    var level slog.Level
+    err := level.UnmarshalText([]byte(name))
+    if err != nil || strings.ContainsAny(name, "+-") {
+        return level, errors.New("unknown log level '" + name + "', use debug, info, warn or error")
+    }
+    return level, nil
+}
+
+/*
+**  newLogger - a leveled logger writing format to w
+*/
+func newLogger(w io.Writer, format string, level slog.Level) (*slog.Logger, error) {
+    options := &slog.HandlerOptions{Level: level}
+    switch format {
+    case logJSON:
+        return slog.New(slog.NewJSONHandler(w, options)), nil
+    case logLogfmt:
+        return slog.New(slog.NewTextHandler(w, options)), nil
+    }
+    return nil, errors.New("unknown log format '" + format + "', use json or logfmt")
+}
+
+/*
+**  setupLogging - sends all logging, including the log package, to stderr
+**                 in format at level.  verbose forces debug
+*/
+func setupLogging(format, levelName string, verbose bool) error {
+    level, err := parseLogLevel(levelName)
+    if err != nil {
+        return err
+    }
+    if verbose {
+        level = slog.LevelDebug
+    }
+    logger, err := newLogger(os.Stderr, format, level)
+    if err != nil {
+        return err
+    }
+    slog.SetDefault(logger)
+    return nil
+}
+
+/*
+**  fatal - logs msg at error level and exits
+*/
+func fatal(msg string, args ...any) {
+    slog.Error(msg, args...)
+    os.Exit(1)
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+    "testing"
+    "bytes"
+    "strings"
+    "log/slog"
+    json "encoding/json"
+)
+
+func TestParseLogLevel(t *testing.T) {
+    for name, level := range map[string] slog.Level{"debug": slog.LevelDebug, "INFO": slog.LevelInfo, "warn": slog.LevelWarn, "error": slog.LevelError} {
+        if parsed, err := parseLogLevel(name); err != nil || parsed != level {
+            t.Errorf("Expected %s to be %s, got %s, %v", name, level, parsed, err)
+        }
+    }
+    for _, name := range []string{"", "loud", "info+2"} {
+        if _, err := parseLogLevel(name); err == nil {
+            t.Errorf("Log level '%s' should have been refused", name)
+        }
+    }
+}
+
+func TestNewLogger(t *testing.T) {
+    var out bytes.Buffer
+    logger, err := newLogger(&out, logJSON, slog.LevelInfo)
+    if err != nil {
+        t.Fatalf("Failed to build json logger: %s", err)
+    }
+    logger.Debug("hidden")
+    logger.Warn("Run failed", "service", "shovel", "link", linkBATS, "exit_code", 3)
+
+    var line map[string] interface{}
+    if err := json.Unmarshal(out.Bytes(), &line); err != nil {
+        t.Fatalf("Expected one json line, got %s: %s", out.String(), err)
+    }
+    if line["level"] != "WARN" || line["service"] != "shovel" || line["link"] != "bats" || line["exit_code"] != float64(3) {
+        t.Errorf("Unexpected json log line: %s", out.String())
+    }
+
+    out.Reset()
+    logger, _ = newLogger(&out, logLogfmt, slog.LevelDebug)
+    logger.Debug("Link changed", "from", linkVSAT, "link", linkBATS)
+    if !strings.Contains(out.String(), "level=DEBUG msg=\"Link changed\" from=vsat link=bats") {
+        t.Errorf("Unexpected logfmt line: %s", out.String())
+    }
+
+    if _, err := newLogger(&out, "xml", slog.LevelInfo); err == nil {
+        t.Error("Unknown log format should be refused")
+    }
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+  "io"
+  "fmt"
+  "errors"
+  "sort"
+  "sync"
+  "time"
+  "strings"
+  "strconv"
+  http "net/http"
+)
+
+//  histogram buckets, in seconds
+var (
+    ziPollBuckets       = []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+    runDurationBuckets  = []float64{1, 5, 15, 60, 300, 900, 1800, 3600}
+)
+
+/*
+**  histogram - a prometheus histogram, counts are per bucket, not cumulative
+*/
+type histogram struct {
+    buckets []float64
+    counts  []uint64
+    sum     float64
+    count   uint64
+}
+
+func newHistogram(buckets []float64) *histogram {
+    return &histogram{buckets: buckets, counts: make([]uint64, len(buckets))}
+}
+
+func (h *histogram) observe(value float64) {
+    for i, bound := range h.buckets {
+        if value <= bound {
+            h.counts[i]++
+            break
+        }
+    }
+    h.sum += value
+    h.count++
+}
+
+/*
+**  relayMetrics - counters and histograms updated as things happen.  the
+**                 link and running gauges are read at scrape time
+*/
+type relayMetrics struct {
+    sync.Mutex
+    ziPolls         map[string] uint64          //  by result
+    ziPollLatency   *histogram
+    transitions     map[[2]linkState] uint64    //  from, to
+    runs            map[[2]string] uint64       //  service, outcome
+    runDurations    map[string] *histogram      //  by service
+    promotions      map[string] uint64          //  by job result
+}
+
+func newRelayMetrics() *relayMetrics {
+    return &relayMetrics{
+        ziPolls:        make(map[string] uint64),
+        ziPollLatency:  newHistogram(ziPollBuckets),
+        transitions:    make(map[[2]linkState] uint64),
+        runs:           make(map[[2]string] uint64),
+        runDurations:   make(map[string] *histogram),
+        promotions:     make(map[string] uint64),
+    }
+}
+
+var metrics = newRelayMetrics()
+
+//  outcome - success, timeout or failure, for err
+func outcome(err error) string {
+    if errors.Is(err, errRunTimeout) {
+        return "timeout"
+    } else if err != nil {
+        return "failure"
+    }
+    return "success"
+}
+
+func (r *relayMetrics) ziPolled(latency time.Duration, err error) {
+    r.Lock()
+    defer r.Unlock()
+    r.ziPolls[outcome(err)]++
+    r.ziPollLatency.observe(latency.Seconds())
+}
+
+func (r *relayMetrics) linkChanged(from, to linkState) {
+    r.Lock()
+    defer r.Unlock()
+    r.transitions[[2]linkState{from, to}]++
+}
+
+func (r *relayMetrics) serviceRan(name string, duration time.Duration, err error) {
+    r.Lock()
+    defer r.Unlock()
+    r.runs[[2]string{name, outcome(err)}]++
+    if r.runDurations[name] == nil {
+        r.runDurations[name] = newHistogram(runDurationBuckets)
+    }
+    r.runDurations[name].observe(duration.Seconds())
+}
+
+//  promoted - counts a promote job by its jenkins result, error if it never got one
+func (r *relayMetrics) promoted(result string) {
+    r.Lock()
+    defer r.Unlock()
+    r.promotions[result]++
+}
+
+/*
+**  metricsHandle - prometheus text exposition of everything above plus the
+**                  current link and which services are running
+*/
+func metricsHandle(w http.ResponseWriter, r *http.Request) {
+    if r.Method != "GET" {
+        w.WriteHeader(405)
+        fmt.Fprintf(w, "Only accepts GET")
+        return
+    }
+    w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+    link := monitor.report()
+    current := link.Published.State
+    if link.Override != nil {
+        current = link.Override.State
+    }
+    header(w, "zi_relay_link_state", "gauge", "1 for the link state currently published to services")
+    for state := linkUnknown; state <= linkBATS; state++ {
+        value := 0
+        if state == current {
+            value = 1
+        }
+        fmt.Fprintf(w, "zi_relay_link_state{state=%q} %d\n", state.String(), value)
+    }
+    header(w, "zi_relay_link_override", "gauge", "1 while an operator override is in force")
+    fmt.Fprintf(w, "zi_relay_link_override %d\n", boolValue(link.Override != nil))
+    header(w, "zi_relay_link_last_good_timestamp_seconds", "gauge", "when the sources last gave a known link state")
+    fmt.Fprintf(w, "zi_relay_link_last_good_timestamp_seconds %d\n", link.Published.LastGood.Unix())
+    header(w, "zi_relay_link_stale_seconds", "gauge", "how long the link has been unknown, 0 while it is known")
+    fmt.Fprintf(w, "zi_relay_link_stale_seconds %g\n", link.Published.staleFor().Seconds())
+
+    var statuses []serviceStatus
+    if services != nil {
+        statuses = services.statuses()
+    }
+    header(w, "zi_relay_service_running", "gauge", "1 while the service's command is running")
+    for _, status := range statuses {
+        fmt.Fprintf(w, "zi_relay_service_running{service=%s} %d\n", quoteLabel(status.Name), boolValue(status.Running))
+    }
+
+    metrics.write(w)
+}
+
+func (r *relayMetrics) write(w io.Writer) {
+    r.Lock()
+    defer r.Unlock()
+
+    header(w, "zi_relay_zi_polls_total", "counter", "ZeroImpact polls by result")
+    for _, result := range []string{"success", "failure"} {
+        fmt.Fprintf(w, "zi_relay_zi_polls_total{result=%q} %d\n", result, r.ziPolls[result])
+    }
+    header(w, "zi_relay_zi_poll_duration_seconds", "histogram", "ZeroImpact poll latency")
+    writeHistogram(w, "zi_relay_zi_poll_duration_seconds", "", r.ziPollLatency)
+
+    header(w, "zi_relay_link_transitions_total", "counter", "published link state changes")
+    transitions := make([][2]linkState, 0, len(r.transitions))
+    for transition := range r.transitions {
+        transitions = append(transitions, transition)
+    }
+    sort.Slice(transitions, func(i, j int) bool {
+        if transitions[i][0] != transitions[j][0] {
+            return transitions[i][0] < transitions[j][0]
+        }
+        return transitions[i][1] < transitions[j][1]
+    })
+    for _, transition := range transitions {
+        fmt.Fprintf(w, "zi_relay_link_transitions_total{from=%q,to=%q} %d\n", transition[0].String(), transition[1].String(), r.transitions[transition])
+    }
+
+    header(w, "zi_relay_service_runs_total", "counter", "service runs by outcome")
+    runs := make([][2]string, 0, len(r.runs))
+    for run := range r.runs {
+        runs = append(runs, run)
+    }
+    sort.Slice(runs, func(i, j int) bool {
+        if runs[i][0] != runs[j][0] {
+            return runs[i][0] < runs[j][0]
+        }
+        return runs[i][1] < runs[j][1]
+    })
+    for _, run := range runs {
+        fmt.Fprintf(w, "zi_relay_service_runs_total{service=%s,outcome=%q} %d\n", quoteLabel(run[0]), run[1], r.runs[run])
+    }
+
+    header(w, "zi_relay_service_run_duration_seconds", "histogram", "service run durations")
+    names := make([]string, 0, len(r.runDurations))
+    for name := range r.runDurations {
+        names = append(names, name)
+    }
+    sort.Strings(names)
+    for _, name := range names {
+        writeHistogram(w, "zi_relay_service_run_duration_seconds", "service=" + quoteLabel(name), r.runDurations[name])
+    }
+
+    header(w, "zi_relay_promote_jobs_total", "counter", "jenkins promote-to-ship jobs by result")
+    results := make([]string, 0, len(r.promotions))
+    for result := range r.promotions {
+        results = append(results, result)
+    }
+    sort.Strings(results)
+    for _, result := range results {
+        fmt.Fprintf(w, "zi_relay_promote_jobs_total{result=%s} %d\n", quoteLabel(result), r.promotions[result])
+    }
+}
+
+func header(w io.Writer, name, kind, help string) {
+    fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+/*
+**  writeHistogram - the cumulative buckets, sum and count of h.  labels
+**                   are any extra labels, already formatted
+*/
+func writeHistogram(w io.Writer, name, labels string, h *histogram) {
+    prefix := ""
+    if labels != "" {
+        prefix = labels + ","
+    }
+    cumulative := uint64(0)
+    for i, bound := range h.buckets {
+        cumulative += h.counts[i]
+        fmt.Fprintf(w, "%s_bucket{%sle=\"%s\"} %d\n", name, prefix, strconv.FormatFloat(bound, 'g', -1, 64), cumulative)
+    }
+    fmt.Fprintf(w, "%s_bucket{%sle=\"+Inf\"} %d\n", name, prefix, h.count)
+    if labels != "" {
+        labels = "{" + labels + "}"
+    }
+    fmt.Fprintf(w, "%s_sum%s %s\n", name, labels, strconv.FormatFloat(h.sum, 'g', -1, 64))
+    fmt.Fprintf(w, "%s_count%s %d\n", name, labels, h.count)
+}
+
+//  quoteLabel - a label value quoted and escaped the way prometheus wants
+func quoteLabel(value string) string {
+    value = strings.ReplaceAll(value, `\`, `\\`)
+    value = strings.ReplaceAll(value, `"`, `\"`)
+    value = strings.ReplaceAll(value, "\n", `\n`)
+    return `"` + value + `"`
+}
+
+func boolValue(b bool) int {
+    if b {
+        return 1
+    }
+    return 0
+}
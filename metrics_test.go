@@ -0,0 +1,78 @@
+package main
+
+import (
+    "testing"
+    "context"
+    "errors"
+    "strings"
+    "strconv"
+    "time"
+    httptest "net/http/httptest"
+)
+
+func TestMetricsHandle(t *testing.T) {
+    metrics = newRelayMetrics()
+    ctx, cancel := context.WithCancel(context.Background())
+    defer cancel()
+    services = newServiceManager(ctx)
+    services.services["shovel"] = newManagedService(ctx, serviceConfig{Name: "shovel"})
+    services.services["shovel"].state.update(func(s *serviceStatus) { s.Running = true })
+    monitor = newLinkMonitor(nil, monitorConfig{Interval: 5}, services)
+    lastGood := time.Now().Add(-time.Minute)
+    monitor.debounce(linkStatus{State: linkBATS, LastGood: lastGood}, time.Now())
+
+    metrics.ziPolled(30 * time.Millisecond, nil)
+    metrics.ziPolled(3 * time.Second, errors.New("timeout"))
+    metrics.serviceRan("chef-client", 90 * time.Second, nil)
+    metrics.serviceRan("chef-client", 2 * time.Second, errors.New("exit status 1"))
+    metrics.promoted("SUCCESS")
+
+    w := httptest.NewRecorder()
+    metricsHandle(w, httptest.NewRequest("GET", "/metrics", nil))
+    body := w.Body.String()
+    for _, line := range []string{
+        `zi_relay_link_state{state="bats"} 1`,
+        `zi_relay_link_state{state="vsat"} 0`,
+        `zi_relay_link_override 0`,
+        `zi_relay_link_last_good_timestamp_seconds ` + strconv.FormatInt(lastGood.Unix(), 10),
+        `zi_relay_link_stale_seconds 0`,
+        `zi_relay_service_running{service="shovel"} 1`,
+        `zi_relay_zi_polls_total{result="success"} 1`,
+        `zi_relay_zi_polls_total{result="failure"} 1`,
+        `zi_relay_zi_poll_duration_seconds_bucket{le="0.05"} 1`,
+        `zi_relay_zi_poll_duration_seconds_bucket{le="2.5"} 1`,
+        `zi_relay_zi_poll_duration_seconds_bucket{le="5"} 2`,
+        `zi_relay_zi_poll_duration_seconds_count 2`,
+        `zi_relay_link_transitions_total{from="unknown",to="bats"} 1`,
+        `zi_relay_service_runs_total{service="chef-client",outcome="failure"} 1`,
+        `zi_relay_service_runs_total{service="chef-client",outcome="success"} 1`,
+        `zi_relay_service_run_duration_seconds_bucket{service="chef-client",le="5"} 1`,
+        `zi_relay_service_run_duration_seconds_bucket{service="chef-client",le="300"} 2`,
+        `zi_relay_service_run_duration_seconds_sum{service="chef-client"} 92`,
+        `zi_relay_promote_jobs_total{result="SUCCESS"} 1`,
+    } {
+        if !strings.Contains(body, line + "\n") {
+            t.Errorf("Missing %s from metrics:\n%s", line, body)
+        }
+    }
+
+    //  unknown since lastGood
+    monitor.debounce(linkStatus{State: linkUnknown, LastGood: lastGood}, time.Now())
+    w = httptest.NewRecorder()
+    metricsHandle(w, httptest.NewRequest("GET", "/metrics", nil))
+    stale := -1.0
+    for _, line := range strings.Split(w.Body.String(), "\n") {
+        if value, found := strings.CutPrefix(line, "zi_relay_link_stale_seconds "); found {
+            stale, _ = strconv.ParseFloat(value, 64)
+        }
+    }
+    if stale < 60 || stale > 70 {
+        t.Errorf("Expected the link stale for a minute, got %g", stale)
+    }
+}
+
+func TestQuoteLabel(t *testing.T) {
+    if quoted := quoteLabel("a \"b\"\\c\n"); quoted != `"a \"b\"\\c\n"` {
+        t.Errorf("Badly escaped label %s", quoted)
+    }
+}
@@ -0,0 +1,426 @@
+package main
+
+import (
+  "log/slog"
+  "sync"
+  "time"
+  "strings"
+  "context"
+)
+
+/*
+**  linkMonitor - polls the link sources, debounces the link state and
+**                publishes it to every managed service
+**    published - the last status handed to the services
+**    candidate - a link state seen but not yet published, for
+**                candidatePolls polls since candidateSince
+**    flaps     - candidates dropped before they were published
+**    readings  - what each source said on the last poll
+**    disagreements - polls where the sources that answered disagreed
+**    override  - link state forced by an operator, nil if there is none
+**    lastPoll  - when run last finished a poll
+**    lastZIPoll - when a ZI source last answered
+**    polled    - closed once run has finished its first poll
+*/
+type linkMonitor struct {
+    sync.Mutex
+    sources         []LinkSource
+    config          monitorConfig
+    feeds           *serviceManager
+
+    known           linkStatus
+    published       linkStatus
+    havePublished   bool
+    candidate       linkState
+    candidateSince  time.Time
+    candidatePolls  int
+    flaps           int
+    readings        []sourceReading
+    disagreements   int
+    override        *linkOverride
+    lastPoll        time.Time
+    lastZIPoll      time.Time
+    polled          chan bool
+}
+
+/*
+**  linkOverride - an operator forcing the link state until Expires
+*/
+type linkOverride struct {
+    State   linkState   `json:"link"`
+    Set     time.Time   `json:"set"`
+    Expires time.Time   `json:"expires"`
+}
+
+/*
+**  sourceReading - one source's answer to a poll.  State is unknown if
+**                  the source failed with Err
+*/
+type sourceReading struct {
+    Source  string      `json:"source"`
+    State   linkState   `json:"link"`
+    Err     string      `json:"error,omitempty"`
+}
+
+func newLinkMonitor(sources []LinkSource, config monitorConfig, feeds *serviceManager) *linkMonitor {
+    return &linkMonitor{
+        sources:    sources,
+        config:     config,
+        feeds:      feeds,
+        known:      linkStatus{State: linkUnknown, Known: linkUnknown, LastGood: time.Now()},
+        polled:     make(chan bool),
+    }
+}
+
+/*
+**  configure - swap in new sources, poll interval and debounce settings
+*/
+func (m *linkMonitor) configure(sources []LinkSource, config monitorConfig) {
+    m.Lock()
+    defer m.Unlock()
+    m.sources = sources
+    m.config = config
+}
+
+/*
+**  run - polls until ctx is cancelled
+*/
+func (m *linkMonitor) run(ctx context.Context) {
+    for ctx.Err() == nil {
+        status := m.debounce(m.poll(ctx), time.Now())
+        if ctx.Err() != nil {
+            return  //  the poll was cut short, don't act on it
+        }
+
+        m.Lock()
+        m.feedLocked(status)
+        if m.lastPoll.IsZero() {
+            close(m.polled)
+        }
+        m.lastPoll = time.Now()
+        interval := m.config.Interval
+        m.Unlock()
+        timer := time.NewTimer(time.Duration(interval) * time.Second)
+        select {
+        case <-timer.C:
+        case <-ctx.Done():
+            timer.Stop()
+        }
+    }
+}
+
+/*
+**  firstPoll - closed once run has finished its first poll
+*/
+func (m *linkMonitor) firstPoll() <-chan bool {
+    return m.polled
+}
+
+/*
+**  healthy - has run finished a poll recently.  a poll can take a few
+**            intervals when sources are slow, it is only stuck once it is
+**            well past that
+*/
+func (m *linkMonitor) healthy(now time.Time) bool {
+    m.Lock()
+    defer m.Unlock()
+    stuckAfter := 3 * time.Duration(m.config.Interval) * time.Second + max(commandSourceTimeout, ziSourceTimeout)
+    return !m.lastPoll.IsZero() && now.Sub(m.lastPoll) < stuckAfter
+}
+
+/*
+**  poll - asks every source for the current state and combines their
+**         answers with the configured rule
+*/
+func (m *linkMonitor) poll(ctx context.Context) linkStatus {
+    m.Lock()
+    sources := m.sources
+    rule := m.config.Rule
+    m.Unlock()
+
+    status := m.known
+    var ziPolled time.Time
+    readings := make([]sourceReading, 0, len(sources))
+    for _, source := range sources {
+        polled, err := source.Poll(ctx)
+        reading := sourceReading{Source: source.Name(), State: polled.State}
+        if err != nil {
+            slog.Warn("Link source failed", "source", source.Name(), "error", err)
+            reading.State = linkUnknown
+            reading.Err = err.Error()
+        } else if _, isZI := source.(*ziSource); isZI {
+            //  only ZI knows about devices, keep the last ZI details otherwise
+            status.ZI = polled.ZI
+            ziPolled = time.Now()
+        }
+        readings = append(readings, reading)
+    }
+
+    disagree := disagreement(readings)
+    m.Lock()
+    m.readings = readings
+    if !ziPolled.IsZero() {
+        m.lastZIPoll = ziPolled
+    }
+    if disagree {
+        m.disagreements++
+    }
+    m.Unlock()
+    if disagree {
+        slog.Warn("Link sources disagree", "readings", formatReadings(readings))
+    }
+
+    status.State = combineReadings(rule, readings)
+    if status.State != linkUnknown {
+        status.Known = status.State
+        status.LastGood = time.Now()
+    } else {
+        slog.Warn("No link state from the sources", "rule", rule, "stale_for", status.staleFor().Round(time.Second))
+    }
+    m.known = status
+    return status
+}
+
+/*
+**  combineReadings - the link state rule derives from the readings
+**    rulePriority - the first source that answered
+**    ruleAll      - every source answered with the same state
+**    ruleMajority - the state more than half of the sources answered
+**  unknown if the rule isn't met
+*/
+func combineReadings(rule string, readings []sourceReading) linkState {
+    switch rule {
+    case ruleAll:
+        for _, reading := range readings {
+            if reading.Err != "" || reading.State != readings[0].State {
+                return linkUnknown
+            }
+        }
+        if len(readings) > 0 {
+            return readings[0].State
+        }
+    case ruleMajority:
+        votes := make(map[linkState] int)
+        for _, reading := range readings {
+            if reading.Err == "" {
+                votes[reading.State]++
+                if votes[reading.State] * 2 > len(readings) {
+                    return reading.State
+                }
+            }
+        }
+    default:
+        for _, reading := range readings {
+            if reading.Err == "" {
+                return reading.State
+            }
+        }
+    }
+    return linkUnknown
+}
+
+/*
+**  disagreement - true if the sources that answered gave different states
+*/
+func disagreement(readings []sourceReading) bool {
+    answered := linkUnknown
+    haveAnswer := false
+    for _, reading := range readings {
+        if reading.Err != "" {
+            continue
+        } else if haveAnswer && reading.State != answered {
+            return true
+        }
+        answered = reading.State
+        haveAnswer = true
+    }
+    return false
+}
+
+func formatReadings(readings []sourceReading) string {
+    formatted := make([]string, 0, len(readings))
+    for _, reading := range readings {
+        if reading.Err != "" {
+            formatted = append(formatted, reading.Source + "=failed")
+        } else {
+            formatted = append(formatted, reading.Source + "=" + reading.State.String())
+        }
+    }
+    return strings.Join(formatted, " ")
+}
+
+/*
+**  debounce - returns the status to publish for the one just polled.  a
+**             new link state is only published once it has been seen for
+**             long enough, using the up thresholds for a better link and
+**             down for a worse one
+*/
+func (m *linkMonitor) debounce(polled linkStatus, now time.Time) linkStatus {
+    m.Lock()
+    defer m.Unlock()
+
+    if !m.havePublished || polled.State == m.published.State {
+        if m.candidatePolls > 0 {
+            m.suppressed()
+        }
+        m.publish(polled)
+        return polled
+    }
+
+    if m.candidatePolls == 0 || polled.State != m.candidate {
+        if m.candidatePolls > 0 {
+            m.suppressed()
+        }
+        m.candidate = polled.State
+        m.candidateSince = now
+        m.candidatePolls = 0
+    }
+    m.candidatePolls++
+
+    threshold := m.config.Debounce.Down
+    if polled.State > m.published.State {
+        threshold = m.config.Debounce.Up
+    }
+    if threshold.reached(m.candidatePolls, now.Sub(m.candidateSince)) {
+        m.publish(polled)
+        return polled
+    }
+    slog.Debug("Link not published yet", "link", polled.State, "polls", m.candidatePolls, "published", m.published.State)
+    return m.published
+}
+
+/*
+**  publish - records status as published and logs link changes.  caller
+**            holds the lock
+*/
+func (m *linkMonitor) publish(status linkStatus) {
+    if status.State != m.published.State || !m.havePublished {
+        slog.Info("Link changed", "from", m.published.State, "link", status.State)
+        metrics.linkChanged(m.published.State, status.State)
+    }
+    m.published = status
+    m.havePublished = true
+    m.candidatePolls = 0
+}
+
+/*
+**  suppressed - counts a dropped candidate as a flap.  caller holds the lock
+*/
+func (m *linkMonitor) suppressed() {
+    m.flaps++
+    slog.Info("Suppressed link flap", "flap", m.candidate, "polls", m.candidatePolls, "link", m.published.State)
+}
+
+/*
+**  overridden - status with the operator override applied, if there is
+**               one that hasn't expired
+*/
+func (m *linkMonitor) overridden(status linkStatus) linkStatus {
+    m.Lock()
+    defer m.Unlock()
+    return m.overriddenLocked(status)
+}
+
+func (m *linkMonitor) overriddenLocked(status linkStatus) linkStatus {
+    if m.override == nil {
+        return status
+    } else if time.Now().After(m.override.Expires) {
+        slog.Info("Link override expired", "override", m.override.State, "link", status.State)
+        m.override = nil
+        return status
+    }
+
+    status.State = m.override.State
+    status.Override = true
+    return status
+}
+
+/*
+**  feedLocked - hands status to the services with the override applied.
+**               both under one hold of the lock, so a poll can't publish
+**               over a newer override with an older status.  caller holds
+**               the lock
+*/
+func (m *linkMonitor) feedLocked(status linkStatus) {
+    m.feeds.publish(m.overriddenLocked(status))
+}
+
+/*
+**  setOverride - forces the link to state until expires and publishes it
+**                right away, bypassing the debouncing
+*/
+func (m *linkMonitor) setOverride(state linkState, expires time.Time) {
+    m.Lock()
+    defer m.Unlock()
+    m.override = &linkOverride{State: state, Set: time.Now(), Expires: expires}
+    slog.Info("Link overridden", "link", state, "until", expires.Format(time.RFC3339), "sources_say", m.published.State)
+    m.feedLocked(m.published)
+}
+
+/*
+**  clearOverride - drops the override and publishes the real link again
+*/
+func (m *linkMonitor) clearOverride() {
+    m.Lock()
+    defer m.Unlock()
+    if m.override != nil {
+        m.override = nil
+        slog.Info("Link override cleared", "link", m.published.State)
+        m.feedLocked(m.published)
+    }
+}
+
+/*
+**  reached - has a candidate been seen for enough polls or long enough.
+**            with no thresholds set every change is published right away
+*/
+func (t debounceThreshold) reached(polls int, seen time.Duration) bool {
+    if t.Polls == 0 && t.Seconds == 0 {
+        return true
+    }
+    return (t.Polls > 0 && polls >= t.Polls) || (t.Seconds > 0 && seen >= time.Duration(t.Seconds) * time.Second)
+}
+
+/*
+**  linkReport - snapshot of the monitor for the status server
+*/
+type linkReport struct {
+    Published       linkStatus
+    Source          string
+    LastZIPoll      time.Time
+    Candidate       linkState
+    Pending         int
+    Flaps           int
+    Readings        []sourceReading
+    Disagreements   int
+    Override        *linkOverride
+}
+
+func (m *linkMonitor) report() linkReport {
+    m.Lock()
+    defer m.Unlock()
+    source := ""
+    for _, reading := range m.readings {
+        if reading.Err == "" && reading.State == m.published.State {
+            source = reading.Source
+            break
+        }
+    }
+    //  an expired override is only cleared by the next poll, which also
+    //  publishes the real link, until then it is just left out
+    override := m.override
+    if override != nil && time.Now().After(override.Expires) {
+        override = nil
+    }
+    return linkReport{
+        Published:      m.published,
+        Source:         source,
+        LastZIPoll:     m.lastZIPoll,
+        Candidate:      m.candidate,
+        Pending:        m.candidatePolls,
+        Flaps:          m.flaps,
+        Readings:       m.readings,
+        Disagreements:  m.disagreements,
+        Override:       override,
+    }
+}
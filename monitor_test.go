@@ -0,0 +1,236 @@
+package main
+
+import (
+    "testing"
+    "time"
+    "strings"
+    "context"
+    httptest "net/http/httptest"
+)
+
+func TestDebounce(t *testing.T) {
+    config := monitorConfig{Interval: 5}
+    config.Debounce.Up = debounceThreshold{Polls: 3}
+    config.Debounce.Down = debounceThreshold{Seconds: 60}
+    m := newLinkMonitor(nil, config, nil)
+
+    now := time.Now()
+    poll := func(state linkState) linkState {
+        now = now.Add(5 * time.Second)
+        return m.debounce(linkStatus{State: state}, now).State
+    }
+
+    //  the first status is published right away
+    if state := poll(linkBATS); state != linkBATS {
+        t.Fatalf("Expected the first poll to publish bats, got %s", state)
+    }
+
+    //  a short drop to vsat is a flap
+    if state := poll(linkVSAT); state != linkBATS {
+        t.Errorf("vsat should not have been published after one poll, got %s", state)
+    }
+    poll(linkBATS)
+    if m.report().Flaps != 1 {
+        t.Errorf("Expected one suppressed flap, got %d", m.report().Flaps)
+    }
+
+    //  going down takes 60 seconds
+    for i := 0; i < 12; i++ {
+        if state := poll(linkVSAT); state != linkBATS {
+            t.Fatalf("vsat published after %d polls, should take 60 seconds", i + 1)
+        }
+    }
+    if state := poll(linkVSAT); state != linkVSAT {
+        t.Errorf("vsat should have been published after 60 seconds, got %s", state)
+    }
+
+    //  going up takes 3 polls
+    poll(linkBATS)
+    poll(linkBATS)
+    if m.report().Pending != 2 {
+        t.Errorf("Expected bats pending for 2 polls, got %d", m.report().Pending)
+    }
+    if state := poll(linkBATS); state != linkBATS {
+        t.Errorf("bats should have been published after 3 polls, got %s", state)
+    }
+    if m.report().Flaps != 1 {
+        t.Errorf("Expected still one suppressed flap, got %d", m.report().Flaps)
+    }
+}
+
+func TestDebounceOff(t *testing.T) {
+    m := newLinkMonitor(nil, monitorConfig{Interval: 5}, nil)
+    for _, state := range []linkState{linkBATS, linkVSAT, linkUnknown, linkLTE} {
+        if published := m.debounce(linkStatus{State: state}, time.Now()).State; published != state {
+            t.Errorf("Without debouncing %s should be published right away, got %s", state, published)
+        }
+    }
+}
+
+func TestStatusHandle(t *testing.T) {
+    config := monitorConfig{Interval: 5}
+    config.Debounce.Down = debounceThreshold{Polls: 2}
+    monitor = newLinkMonitor(nil, config, nil)
+    monitor.debounce(linkStatus{State: linkBATS}, time.Now())
+    monitor.debounce(linkStatus{State: linkUnknown}, time.Now())
+
+    report := getStatus(t)
+    if report.Link != linkBATS || report.Pending == nil || report.Pending.Link != linkUnknown || report.Pending.Polls != 1 || report.Flaps != 0 {
+        t.Errorf("Unexpected status: %+v", report)
+    }
+}
+
+func TestCombineReadings(t *testing.T) {
+    bats := sourceReading{Source: "zi", State: linkBATS}
+    vsat := sourceReading{Source: "route", State: linkVSAT}
+    failed := sourceReading{Source: "file", State: linkUnknown, Err: "no such file"}
+
+    cases := []struct {
+        rule        string
+        readings    []sourceReading
+        link        linkState
+    }{
+        {rulePriority, []sourceReading{failed, vsat, bats}, linkVSAT},
+        {rulePriority, []sourceReading{failed}, linkUnknown},
+        {ruleAll, []sourceReading{bats, bats}, linkBATS},
+        {ruleAll, []sourceReading{bats, vsat}, linkUnknown},
+        {ruleAll, []sourceReading{bats, failed}, linkUnknown},
+        {ruleMajority, []sourceReading{bats, vsat, bats}, linkBATS},
+        {ruleMajority, []sourceReading{bats, vsat, failed}, linkUnknown},
+        {ruleMajority, []sourceReading{bats, bats, failed}, linkBATS},
+    }
+    for i, c := range cases {
+        if link := combineReadings(c.rule, c.readings); link != c.link {
+            t.Errorf("case %d, %s: expected %s, got %s", i, c.rule, c.link, link)
+        }
+    }
+
+    if !disagreement([]sourceReading{bats, failed, vsat}) {
+        t.Error("bats and vsat should disagree")
+    }
+    if disagreement([]sourceReading{bats, failed, bats}) {
+        t.Error("a failed source should not count as disagreeing")
+    }
+}
+
+func TestMonitorDisagreement(t *testing.T) {
+    bats, _ := newLinkSource(sourceConfig{Type: sourceCommand, Name: "one", Command: []string{"echo", "bats"}}, "")
+    vsat, _ := newLinkSource(sourceConfig{Type: sourceCommand, Name: "two", Command: []string{"echo", "vsat"}}, "")
+    monitor = newLinkMonitor([]LinkSource{bats, vsat}, monitorConfig{Interval: 5, Rule: ruleAll}, nil)
+
+    status := monitor.debounce(monitor.poll(context.Background()), time.Now())
+    if status.State != linkUnknown {
+        t.Errorf("Disagreeing sources should be unknown under the all rule, got %s", status.State)
+    }
+
+    report := getStatus(t)
+    one := sourceReading{Source: "one", State: linkBATS}
+    two := sourceReading{Source: "two", State: linkVSAT}
+    if len(report.Readings) != 2 || report.Readings[0] != one || report.Readings[1] != two || report.Disagreements != 1 {
+        t.Errorf("Unexpected status: %+v", report)
+    }
+}
+
+func TestOverrideHandle(t *testing.T) {
+    feeds := newServiceManager(context.Background())
+    monitor = newLinkMonitor(nil, monitorConfig{Interval: 5}, feeds)
+    monitor.debounce(linkStatus{State: linkVSAT}, time.Now())
+
+    w := httptest.NewRecorder()
+    r := httptest.NewRequest("POST", "/override", strings.NewReader("link=bats&for=1h"))
+    r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+    overrideHandle(w, r)
+    if w.Code != 200 {
+        t.Fatalf("Failed to set override: %d %s", w.Code, w.Body.String())
+    }
+
+    status, _ := feeds.status()
+    if status.State != linkBATS || !status.Override {
+        t.Errorf("Override should have been published right away, got %+v", status)
+    }
+
+    report := getStatus(t)
+    if report.Link != linkBATS || report.Source != "override" || report.SourcesSay == nil || *report.SourcesSay != linkVSAT {
+        t.Errorf("Status should show the override, got: %+v", report)
+    }
+
+    w = httptest.NewRecorder()
+    overrideHandle(w, httptest.NewRequest("GET", "/override", nil))
+    if !strings.HasPrefix(w.Body.String(), "override: bats until ") {
+        t.Errorf("Unexpected override body: %s", w.Body.String())
+    }
+
+    w = httptest.NewRecorder()
+    overrideHandle(w, httptest.NewRequest("DELETE", "/override", nil))
+    status, _ = feeds.status()
+    if status.State != linkVSAT || status.Override {
+        t.Errorf("Clearing the override should publish the real link, got %+v", status)
+    }
+
+    for _, form := range []string{"link=wifi&for=1h", "link=bats", "link=bats&until=2001-01-01T00:00:00Z"} {
+        w = httptest.NewRecorder()
+        r = httptest.NewRequest("POST", "/override", strings.NewReader(form))
+        r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+        overrideHandle(w, r)
+        if w.Code != 400 {
+            t.Errorf("%s should have been refused, got %d", form, w.Code)
+        }
+    }
+}
+
+func TestOverrideExpires(t *testing.T) {
+    m := newLinkMonitor(nil, monitorConfig{Interval: 5}, newServiceManager(context.Background()))
+    m.setOverride(linkLTE, time.Now().Add(50 * time.Millisecond))
+    if status := m.overridden(linkStatus{State: linkVSAT}); status.State != linkLTE {
+        t.Errorf("Expected the lte override, got %s", status.State)
+    }
+
+    time.Sleep(100 * time.Millisecond)
+    if m.report().Override != nil {
+        t.Error("Expired override should not be reported before the next poll")
+    }
+    if status := m.overridden(linkStatus{State: linkVSAT}); status.State != linkVSAT || status.Override {
+        t.Errorf("Expected the override to have expired, got %+v", status)
+    }
+    if m.report().Override != nil {
+        t.Error("Expired override should have been cleared")
+    }
+}
+
+//  blockingSource - answers state once release is closed
+type blockingSource struct {
+    state   linkState
+    release chan bool
+}
+
+func (s *blockingSource) Name() string {
+    return "blocking"
+}
+
+func (s *blockingSource) Poll(ctx context.Context) (linkStatus, error) {
+    <-s.release
+    return linkStatus{State: s.state}, nil
+}
+
+func TestOverrideDuringPoll(t *testing.T) {
+    ctx, cancel := context.WithCancel(context.Background())
+    defer cancel()
+    feeds := newServiceManager(ctx)
+    source := &blockingSource{state: linkVSAT, release: make(chan bool)}
+    m := newLinkMonitor([]LinkSource{source}, monitorConfig{Interval: 60}, feeds)
+    go m.run(ctx)
+
+    //  the poll finishing after the override must not publish over it
+    time.Sleep(50 * time.Millisecond)
+    m.setOverride(linkLTE, time.Now().Add(time.Hour))
+    close(source.release)
+    <-m.firstPoll()
+    if status, _ := feeds.status(); status.State != linkLTE || !status.Override {
+        t.Errorf("Expected the lte override to stay published, got %+v", status)
+    }
+
+    m.clearOverride()
+    if status, _ := feeds.status(); status.State != linkVSAT || status.Override {
+        t.Errorf("Expected the polled vsat once cleared, got %+v", status)
+    }
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+  "os"
+  "fmt"
+  "sync"
+  "bytes"
+  "strconv"
+  "strings"
+  "syscall"
+  ioutil "io/ioutil"
+  filepath "path/filepath"
+)
+
+//  the pidfile held for the life of the process, nil if there is none
+var (
+    pidLock     sync.Mutex
+    pidHeld     *os.File
+)
+
+/*
+**  lockPidfile - creates path exclusively and flocks it, writing our pid.
+**                an existing file is taken over if nothing holds its lock
+**                and its pid is stale.  fails if another zi-relay has it
+*/
+func lockPidfile(path string) (*os.File, error) {
+    for attempt := 0; attempt < 3; attempt++ {
+        file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0644)
+        created := err == nil
+        if os.IsExist(err) {
+            file, err = os.OpenFile(path, os.O_RDWR, 0644)
+            if os.IsNotExist(err) {
+                continue  //  removed under us, try creating it again
+            }
+        }
+        if err != nil {
+            return nil, err
+        }
+
+        err = syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+        if err == syscall.EWOULDBLOCK {
+            pid, _ := readPid(file)
+            file.Close()
+            return nil, fmt.Errorf("zi-relay is already running as pid %d, it holds %s", pid, path)
+        } else if err != nil {
+            file.Close()
+            return nil, err
+        }
+
+        //  the holder may have removed the file between our open and flock
+        if !samePidfile(file, path) {
+            file.Close()
+            continue
+        }
+
+        if !created {
+            if pid, err := readPid(file); err == nil && pid != os.Getpid() && !stalePid(pid) {
+                file.Close()
+                return nil, fmt.Errorf("zi-relay is already running as pid %d, from %s", pid, path)
+            }
+        }
+
+        if err = writePid(file); err != nil {
+            file.Close()
+            return nil, err
+        }
+        return file, nil
+    }
+    return nil, fmt.Errorf("%s keeps changing, could not lock it", path)
+}
+
+/*
+**  samePidfile - is path still the file we have open
+*/
+func samePidfile(file *os.File, path string) bool {
+    held, err := file.Stat()
+    if err != nil {
+        return false
+    }
+    current, err := os.Stat(path)
+    return err == nil && os.SameFile(held, current)
+}
+
+func readPid(file *os.File) (int, error) {
+    contents := make([]byte, 32)
+    n, err := file.ReadAt(contents, 0)
+    if n == 0 {
+        return 0, err
+    }
+    return strconv.Atoi(strings.TrimSpace(string(contents[:n])))
+}
+
+func writePid(file *os.File) error {
+    err := file.Truncate(0)
+    if err == nil {
+        _, err = file.WriteAt([]byte(strconv.Itoa(os.Getpid()) + "\n"), 0)
+    }
+    if err == nil {
+        err = file.Sync()
+    }
+    return err
+}
+
+/*
+**  stalePid - true unless pid is alive and running zi-relay
+*/
+func stalePid(pid int) bool {
+    if pid <= 0 {
+        return true
+    }
+    err := syscall.Kill(pid, 0)
+    if err != nil && err != syscall.EPERM {
+        return true
+    }
+
+    cmdline, err := ioutil.ReadFile("/proc/" + strconv.Itoa(pid) + "/cmdline")
+    if err != nil {
+        return true
+    }
+    argv0 := cmdline
+    if end := bytes.IndexByte(cmdline, 0); end >= 0 {
+        argv0 = cmdline[:end]
+    }
+    return !strings.Contains(filepath.Base(string(argv0)), "zi-relay")
+}
+
+/*
+**  removePidfileOnPanic - deferred at the top of go routines so a panic
+**                         anywhere still removes the pidfile
+*/
+func removePidfileOnPanic() {
+    if r := recover(); r != nil {
+        remove_pidfile()
+        panic(r)
+    }
+}
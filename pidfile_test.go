@@ -0,0 +1,62 @@
+package main
+
+import (
+    ioutil "io/ioutil"
+    "testing"
+    "strconv"
+    "strings"
+    "os"
+)
+
+func tempPidfile(t *testing.T, contents string) string {
+    file, err := ioutil.TempFile("", "zi-relay-pid")
+    if err != nil {
+        t.Fatalf("could not create pidfile: %s", err)
+    }
+    file.WriteString(contents)
+    file.Close()
+    if contents == "" {
+        os.Remove(file.Name())
+    }
+    return file.Name()
+}
+
+func TestLockPidfile(t *testing.T) {
+    path := tempPidfile(t, "")
+    defer os.Remove(path)
+
+    held, err := lockPidfile(path)
+    if err != nil {
+        t.Fatalf("Failed to take a fresh pidfile: %s", err)
+    }
+    contents, _ := ioutil.ReadFile(path)
+    if strings.TrimSpace(string(contents)) != strconv.Itoa(os.Getpid()) {
+        t.Errorf("Pidfile should hold our pid, has %s", contents)
+    }
+
+    _, err = lockPidfile(path)
+    if err != nil {
+        t.Logf("Correctly refused a held pidfile with: %s", err)
+    } else {
+        t.Error("A pidfile locked by another instance should be refused")
+    }
+    held.Close()
+}
+
+func TestLockPidfileStale(t *testing.T) {
+    //  a pid that isn't running, and one that is but isn't zi-relay
+    for _, pid := range []int{0x3ffffff, os.Getppid()} {
+        path := tempPidfile(t, strconv.Itoa(pid) + "\n")
+        held, err := lockPidfile(path)
+        if err != nil {
+            t.Errorf("Stale pid %d should have been replaced, failed with: %s", pid, err)
+        } else {
+            contents, _ := ioutil.ReadFile(path)
+            if strings.TrimSpace(string(contents)) != strconv.Itoa(os.Getpid()) {
+                t.Errorf("Pidfile should hold our pid, has %s", contents)
+            }
+            held.Close()
+        }
+        os.Remove(path)
+    }
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+  "io"
+  "fmt"
+  "bytes"
+  "context"
+  json "encoding/json"
+  http "net/http"
+  url "net/url"
+)
+
+//  management api defaults
+const (
+    defaultManagementURI    = "http://localhost:15672"
+    defaultManagementUser   = "guest"
+    defaultManagementVhost  = "/"
+)
+
+/*
+**  managementConfig - the rabbitmq management api a shovel is controlled
+**                     through
+**    URI        - base of the api, defaultManagementURI if not set
+**    User       - basic auth user, defaultManagementUser if not set
+**    Password   - basic auth password, the user if not set
+**    Vhost      - the shovel's vhost, defaultManagementVhost if not set
+**    Definition - the value of the shovel's parameter, created on start.
+**                 shovels declared with the service's Shovels have their own
+*/
+type managementConfig struct {
+    URI         string          `json:"uri,omitempty"`
+    User        string          `json:"user,omitempty"`
+    Password    string          `json:"password,omitempty"`
+    Vhost       string          `json:"vhost,omitempty"`
+    Definition  json.RawMessage `json:"definition,omitempty"`
+}
+
+/*
+**  managementShovel - a dynamic shovel controlled through the management
+**                     api.  its state comes from /api/shovels, starting
+**                     creates its parameter or restarts it if the
+**                     parameter is already there, stopping deletes it
+*/
+type managementShovel struct {
+    config  managementConfig
+    name    string
+}
+
+func newManagementShovel(name string, config managementConfig) *managementShovel {
+    if config.URI == "" {
+        config.URI = defaultManagementURI
+    }
+    if config.User == "" {
+        config.User = defaultManagementUser
+    }
+    if config.Password == "" {
+        config.Password = config.User
+    }
+    if config.Vhost == "" {
+        config.Vhost = defaultManagementVhost
+    }
+    return &managementShovel{config: config, name: name}
+}
+
+/*
+**  request - sends body, if any, as json to the api and decodes a
+**            successful response into v, if set.  returns the status code
+*/
+func (s *managementShovel) request(ctx context.Context, output io.Writer, method, path string, body, v interface{}) (int, error) {
+    var reader io.Reader
+    if body != nil {
+        encoded, err := json.Marshal(body)
+        if err != nil {
+            return 0, err
+        }
+        reader = bytes.NewReader(encoded)
+    }
+    req, err := http.NewRequestWithContext(ctx, method, s.config.URI + path, reader)
+    if err != nil {
+        return 0, err
+    }
+    req.SetBasicAuth(s.config.User, s.config.Password)
+    if body != nil {
+        req.Header.Set("Content-Type", "application/json")
+    }
+
+    resp, err := http.DefaultClient.Do(req)
+    if err != nil {
+        fmt.Fprintf(output, "%s %s: %s\n", method, path, err)
+        return 0, err
+    }
+    defer resp.Body.Close()
+    fmt.Fprintf(output, "%s %s: %s\n", method, path, resp.Status)
+    if v != nil && resp.StatusCode / 100 == 2 {
+        err = json.NewDecoder(resp.Body).Decode(v)
+    }
+    return resp.StatusCode, err
+}
+
+func (s *managementShovel) parameterPath() string {
+    return "/api/parameters/shovel/" + url.PathEscape(s.config.Vhost) + "/" + url.PathEscape(s.name)
+}
+
+func (s *managementShovel) State(ctx context.Context, output io.Writer) (bool, error) {
+    var shovels []struct {
+        Name    string  `json:"name"`
+        State   string  `json:"state"`
+    }
+    status, err := s.request(ctx, output, "GET", "/api/shovels/" + url.PathEscape(s.config.Vhost), nil, &shovels)
+    if err != nil {
+        return false, err
+    } else if status != 200 {
+        return false, fmt.Errorf("management api answered %d for the shovel status", status)
+    }
+    for _, shovel := range shovels {
+        if shovel.Name == s.name {
+            return shovel.State == "running" || shovel.State == "starting", nil
+        }
+    }
+    return false, nil
+}
+
+/*
+**  queueDepth - messages in queue, on the shovel's vhost
+*/
+func (s *managementShovel) queueDepth(ctx context.Context, output io.Writer, queue string) (int, error) {
+    var details struct {
+        Messages    int     `json:"messages"`
+    }
+    status, err := s.request(ctx, output, "GET", "/api/queues/" + url.PathEscape(s.config.Vhost) + "/" + url.PathEscape(queue), nil, &details)
+    if err != nil {
+        return 0, err
+    } else if status != 200 {
+        return 0, fmt.Errorf("management api answered %d for queue %s", status, queue)
+    }
+    return details.Messages, nil
+}
+
+func (s *managementShovel) Start(ctx context.Context, output io.Writer) error {
+    status, err := s.request(ctx, output, "GET", s.parameterPath(), nil, nil)
+    if err != nil {
+        return err
+    }
+
+    if status == 200 {
+        path := "/api/shovels/vhost/" + url.PathEscape(s.config.Vhost) + "/" + url.PathEscape(s.name) + "/restart"
+        status, err = s.request(ctx, output, "DELETE", path, nil, nil)
+    } else if status == 404 {
+        status, err = s.request(ctx, output, "PUT", s.parameterPath(), map[string] json.RawMessage{"value": s.config.Definition}, nil)
+    }
+    if err != nil {
+        return err
+    } else if status / 100 != 2 {
+        return fmt.Errorf("management api answered %d starting the shovel", status)
+    }
+    return nil
+}
+
+func (s *managementShovel) Stop(ctx context.Context, output io.Writer) error {
+    status, err := s.request(ctx, output, "DELETE", s.parameterPath(), nil, nil)
+    if err != nil {
+        return err
+    } else if status / 100 != 2 && status != 404 {
+        return fmt.Errorf("management api answered %d stopping the shovel", status)
+    }
+    return nil
+}
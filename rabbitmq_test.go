@@ -0,0 +1,223 @@
+package main
+
+import (
+    ioutil "io/ioutil"
+    "fmt"
+    "sync"
+    "time"
+    "strings"
+    "testing"
+    "context"
+    json "encoding/json"
+    http "net/http"
+)
+
+var (
+    dummyRabbitLatch = false
+    rabbitLock sync.Mutex
+    rabbitShovels = make(map[string] string)    //  name to state
+    rabbitParameters = make(map[string] string) //  name to value
+    rabbitRestarts = 0
+    rabbitQueues = map[string] int{"outbound": 1234}
+)
+
+func dummyRabbit(){
+    if dummyRabbitLatch {
+        return
+    } else {
+        dummyRabbitLatch = true
+        //  no ServeMux, it would clean the %2F vhost out of the path
+        http.ListenAndServe(":7006", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+            if strings.HasPrefix(r.URL.EscapedPath(), "/api/parameters/shovel/") {
+                rabbitParametersHandle(w, r)
+            } else if strings.HasPrefix(r.URL.EscapedPath(), "/api/queues/") {
+                rabbitQueuesHandle(w, r)
+            } else {
+                rabbitShovelsHandle(w, r)
+            }
+        }))
+    }
+}
+
+func rabbitAuthorized(w http.ResponseWriter, r *http.Request) bool {
+    if user, password, ok := r.BasicAuth(); !ok || user != "relay" || password != "secret" {
+        w.WriteHeader(401)
+        return false
+    }
+    return true
+}
+
+//  GET /api/shovels/%2F and DELETE /api/shovels/vhost/%2F/{name}/restart
+func rabbitShovelsHandle(w http.ResponseWriter, r *http.Request) {
+    if !rabbitAuthorized(w, r) {
+        return
+    }
+    rabbitLock.Lock()
+    defer rabbitLock.Unlock()
+    path := r.URL.EscapedPath()
+    if r.Method == "GET" && path == "/api/shovels/%2F" {
+        shovels := []map[string] string{}
+        for name, state := range rabbitShovels {
+            shovels = append(shovels, map[string] string{"name": name, "vhost": "/", "type": "dynamic", "state": state})
+        }
+        json.NewEncoder(w).Encode(shovels)
+    } else if name := strings.TrimSuffix(strings.TrimPrefix(path, "/api/shovels/vhost/%2F/"), "/restart"); r.Method == "DELETE" && rabbitParameters[name] != "" {
+        rabbitShovels[name] = "running"
+        rabbitRestarts++
+        w.WriteHeader(204)
+    } else {
+        w.WriteHeader(404)
+    }
+}
+
+//  GET, PUT and DELETE /api/parameters/shovel/%2F/{name}
+func rabbitParametersHandle(w http.ResponseWriter, r *http.Request) {
+    if !rabbitAuthorized(w, r) {
+        return
+    }
+    rabbitLock.Lock()
+    defer rabbitLock.Unlock()
+    name := strings.TrimPrefix(r.URL.EscapedPath(), "/api/parameters/shovel/%2F/")
+    switch r.Method {
+    case "GET":
+        if rabbitParameters[name] == "" {
+            w.WriteHeader(404)
+            return
+        }
+        fmt.Fprintf(w, `{"name":%q,"vhost":"/","component":"shovel","value":%s}`, name, rabbitParameters[name])
+    case "PUT":
+        var body struct {
+            Value   json.RawMessage `json:"value"`
+        }
+        err := json.NewDecoder(r.Body).Decode(&body)
+        if err != nil || len(body.Value) == 0 {
+            w.WriteHeader(400)
+            return
+        }
+        rabbitParameters[name] = string(body.Value)
+        rabbitShovels[name] = "running"
+        w.WriteHeader(201)
+    case "DELETE":
+        if rabbitParameters[name] == "" {
+            w.WriteHeader(404)
+            return
+        }
+        delete(rabbitParameters, name)
+        delete(rabbitShovels, name)
+        w.WriteHeader(204)
+    default:
+        w.WriteHeader(405)
+    }
+}
+
+//  GET /api/queues/%2F/{name}
+func rabbitQueuesHandle(w http.ResponseWriter, r *http.Request) {
+    if !rabbitAuthorized(w, r) {
+        return
+    }
+    name := strings.TrimPrefix(r.URL.EscapedPath(), "/api/queues/%2F/")
+    if messages, ok := rabbitQueues[name]; ok && r.Method == "GET" {
+        fmt.Fprintf(w, `{"name":%q,"vhost":"/","messages":%d,"messages_ready":%d}`, name, messages, messages)
+    } else {
+        w.WriteHeader(404)
+    }
+}
+
+func testManagementShovel() *managementShovel {
+    return newManagementShovel("to-ship", managementConfig{
+        URI:        "http://localhost:7006",
+        User:       "relay",
+        Password:   "secret",
+        Definition: json.RawMessage(`{"src-uri": "amqp://", "src-queue": "outbound", "dest-uri": "amqp://ship", "dest-queue": "inbound"}`),
+    })
+}
+
+func TestManagementShovel(t *testing.T) {
+    go dummyRabbit()
+    time.Sleep(100 * time.Millisecond)
+    ctx := context.Background()
+    shovel := testManagementShovel()
+
+    running, err := shovel.State(ctx, ioutil.Discard)
+    if err != nil || running {
+        t.Fatalf("Expected no shovel yet, got %t %v", running, err)
+    }
+
+    err = shovel.Start(ctx, ioutil.Discard)
+    running, _ = shovel.State(ctx, ioutil.Discard)
+    rabbitLock.Lock()
+    definition := rabbitParameters["to-ship"]
+    rabbitLock.Unlock()
+    if err != nil || !running || !strings.Contains(definition, "outbound") {
+        t.Errorf("Expected the shovel parameter created and running, got %v %t %s", err, running, definition)
+    }
+
+    //  a terminated shovel whose parameter is still there gets restarted
+    rabbitLock.Lock()
+    rabbitShovels["to-ship"] = "terminated"
+    rabbitLock.Unlock()
+    running, _ = shovel.State(ctx, ioutil.Discard)
+    err = shovel.Start(ctx, ioutil.Discard)
+    rabbitLock.Lock()
+    restarts := rabbitRestarts
+    rabbitLock.Unlock()
+    if running || err != nil || restarts != 1 {
+        t.Errorf("Expected a terminated shovel restarted, got %t %v after %d restarts", running, err, restarts)
+    }
+
+    err = shovel.Stop(ctx, ioutil.Discard)
+    running, _ = shovel.State(ctx, ioutil.Discard)
+    if err != nil || running {
+        t.Errorf("Expected the shovel deleted, got %v %t", err, running)
+    }
+    err = shovel.Stop(ctx, ioutil.Discard)
+    if err != nil {
+        t.Errorf("Stopping a stopped shovel should be fine, got %v", err)
+    }
+
+    shovel.config.Password = "wrong"
+    _, err = shovel.State(ctx, ioutil.Discard)
+    if err == nil {
+        t.Error("Expected bad credentials to fail")
+    }
+}
+
+func TestManagementQueueDepth(t *testing.T) {
+    go dummyRabbit()
+    time.Sleep(100 * time.Millisecond)
+    shovel := testManagementShovel()
+
+    depth, err := shovel.queueDepth(context.Background(), ioutil.Discard, "outbound")
+    if err != nil || depth != 1234 {
+        t.Errorf("Expected 1234 queued, got %d %v", depth, err)
+    }
+    _, err = shovel.queueDepth(context.Background(), ioutil.Discard, "missing")
+    if err == nil {
+        t.Error("Expected an error for a missing queue")
+    }
+}
+
+func TestManagementBacklogShovel(t *testing.T) {
+    go dummyRabbit()
+    time.Sleep(100 * time.Millisecond)
+    ctx, cancel := context.WithCancel(context.Background())
+    defer cancel()
+    feeds := newServiceManager(ctx)
+    feeds.publish(linkStatus{State: linkVSAT})
+    feeds.apply(&relayConfig{Services: []serviceConfig{
+        {Name: "shovels", Kind: serviceToggle, Backend: shovelManagementAPI, Interval: 1, EnabledOn: []linkState{linkBATS},
+            Management: &managementConfig{URI: "http://localhost:7006", User: "relay", Password: "secret"},
+            Shovels: []shovelConfig{{
+                Name:       "backlog",
+                Definition: json.RawMessage(`{"src-queue": "outbound", "dest-uri": "amqp://ship"}`),
+                Queue:      &queuePolicy{Name: "outbound", StartAbove: 1000, AlsoOn: []linkState{linkVSAT}},
+            }}},
+    }})
+    defer feeds.stopAll()
+
+    time.Sleep(500 * time.Millisecond)
+    shovel := feeds.statuses()[0].Shovels[0]
+    if shovel.State != "running" || shovel.QueueDepth == nil || *shovel.QueueDepth != 1234 {
+        t.Errorf("Expected the backlog to start the shovel over vsat, got %+v", shovel)
+    }
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+  "fmt"
+  "errors"
+  "sync"
+  "time"
+  "strconv"
+  "strings"
+  json "encoding/json"
+  http "net/http"
+)
+
+//  how many runs each service keeps, and how much output from each
+const (
+    runHistorySize  = 20
+    runOutputLimit  = 64 * 1024
+)
+
+/*
+**  tailBuffer - keeps the last limit bytes written to it
+*/
+type tailBuffer struct {
+    sync.Mutex
+    limit       int
+    data        []byte
+    truncated   bool
+}
+
+func (b *tailBuffer) Write(p []byte) (int, error) {
+    b.Lock()
+    defer b.Unlock()
+    b.data = append(b.data, p...)
+    if over := len(b.data) - b.limit; over > 0 {
+        b.data = append(b.data[:0], b.data[over:]...)
+        b.truncated = true
+    }
+    return len(p), nil
+}
+
+func (b *tailBuffer) tail() ([]byte, bool) {
+    b.Lock()
+    defer b.Unlock()
+    return append([]byte{}, b.data...), b.truncated
+}
+
+/*
+**  serviceRun - one run of a service's command or action.  a run with no
+**               finish time is still going
+*/
+type serviceRun struct {
+    ID          int         `json:"id"`
+    Started     time.Time   `json:"started"`
+    Finished    time.Time   `json:"finished,omitzero"`
+    ExitCode    *int        `json:"exitCode,omitempty"`
+    Error       string      `json:"error,omitempty"`
+    TimedOut    bool        `json:"timedOut,omitempty"`
+    OutputBytes int         `json:"outputBytes"`
+    Truncated   bool        `json:"truncated"`
+    output      *tailBuffer
+}
+
+/*
+**  runHistory - the last runHistorySize runs of a service, oldest first.
+**               kept by the service manager so it survives restarts
+*/
+type runHistory struct {
+    sync.Mutex
+    nextID  int
+    runs    []*serviceRun
+}
+
+/*
+**  begin - records a new run, dropping the oldest if the history is full
+*/
+func (h *runHistory) begin(started time.Time) *serviceRun {
+    h.Lock()
+    defer h.Unlock()
+    h.nextID++
+    run := &serviceRun{ID: h.nextID, Started: started, output: &tailBuffer{limit: runOutputLimit}}
+    if len(h.runs) >= runHistorySize {
+        h.runs = append(h.runs[:0], h.runs[1:]...)
+    }
+    h.runs = append(h.runs, run)
+    return run
+}
+
+func (h *runHistory) finish(run *serviceRun, finished time.Time, err error) {
+    h.Lock()
+    defer h.Unlock()
+    run.Finished = finished
+    run.ExitCode = exitCode(err)
+    if err != nil {
+        run.Error = err.Error()
+        run.TimedOut = errors.Is(err, errRunTimeout)
+    }
+}
+
+/*
+**  list - the runs, newest first
+*/
+func (h *runHistory) list() []serviceRun {
+    h.Lock()
+    defer h.Unlock()
+    runs := make([]serviceRun, 0, len(h.runs))
+    for i := len(h.runs) - 1; i >= 0; i-- {
+        run := *h.runs[i]
+        output, truncated := run.output.tail()
+        run.OutputBytes = len(output)
+        run.Truncated = truncated
+        runs = append(runs, run)
+    }
+    return runs
+}
+
+/*
+**  output - the output tail of run id, false if it is no longer kept
+*/
+func (h *runHistory) output(id int) ([]byte, bool) {
+    h.Lock()
+    defer h.Unlock()
+    for _, run := range h.runs {
+        if run.ID == id {
+            output, _ := run.output.tail()
+            return output, true
+        }
+    }
+    return nil, false
+}
+
+/*
+**  servicesHandle - run history of a service
+**    GET /services/{name}/runs             - json list, newest first
+**    GET /services/{name}/runs/{id}/output - the run's output tail
+*/
+func servicesHandle(w http.ResponseWriter, r *http.Request) {
+    if r.Method != "GET" {
+        w.WriteHeader(405)
+        fmt.Fprintf(w, "Only accepts GET")
+        return
+    }
+
+    parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/services/"), "/"), "/")
+    if len(parts) < 2 || parts[1] != "runs" || (len(parts) != 2 && (len(parts) != 4 || parts[3] != "output")) {
+        w.WriteHeader(404)
+        fmt.Fprintf(w, "use /services/{name}/runs or /services/{name}/runs/{id}/output\n")
+        return
+    }
+    history := services.history(parts[0], false)
+    if history == nil {
+        w.WriteHeader(404)
+        fmt.Fprintf(w, "no service %s\n", parts[0])
+        return
+    }
+
+    if len(parts) == 2 {
+        w.Header().Set("Content-Type", "application/json")
+        encoder := json.NewEncoder(w)
+        encoder.SetIndent("", "  ")
+        encoder.Encode(history.list())
+        return
+    }
+
+    id, err := strconv.Atoi(parts[2])
+    output, ok := history.output(id)
+    if err != nil || !ok {
+        w.WriteHeader(404)
+        fmt.Fprintf(w, "no run %s of %s\n", parts[2], parts[0])
+        return
+    }
+    w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+    w.Write(output)
+}
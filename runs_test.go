@@ -0,0 +1,77 @@
+package main
+
+import (
+    "testing"
+    "context"
+    "strings"
+    "time"
+    json "encoding/json"
+    httptest "net/http/httptest"
+)
+
+func TestTailBuffer(t *testing.T) {
+    b := &tailBuffer{limit: 8}
+    b.Write([]byte("hello"))
+    if tail, truncated := b.tail(); string(tail) != "hello" || truncated {
+        t.Errorf("Expected the whole output, got %q, %t", tail, truncated)
+    }
+    b.Write([]byte(" world"))
+    if tail, truncated := b.tail(); string(tail) != "lo world" || !truncated {
+        t.Errorf("Expected the last 8 bytes, got %q, %t", tail, truncated)
+    }
+}
+
+func TestRunHistory(t *testing.T) {
+    h := &runHistory{}
+    for i := 0; i < runHistorySize + 5; i++ {
+        run := h.begin(time.Now())
+        run.output.Write([]byte("run output"))
+        h.finish(run, time.Now(), nil)
+    }
+    runs := h.list()
+    if len(runs) != runHistorySize || runs[0].ID != runHistorySize + 5 || runs[len(runs) - 1].ID != 6 {
+        t.Errorf("Expected the last %d runs newest first, got %d from %d to %d", runHistorySize, len(runs), runs[0].ID, runs[len(runs) - 1].ID)
+    }
+    if _, ok := h.output(5); ok {
+        t.Error("Run 5 should have been dropped")
+    }
+    if output, ok := h.output(6); !ok || string(output) != "run output" {
+        t.Errorf("Expected run 6's output, got %q", output)
+    }
+}
+
+func TestServicesHandle(t *testing.T) {
+    ctx, cancel := context.WithCancel(context.Background())
+    defer cancel()
+    services = newServiceManager(ctx)
+    services.publish(linkStatus{State: linkBATS})
+    services.apply(&relayConfig{Services: []serviceConfig{
+        {Name: "chatty", Kind: serviceCI, Command: []string{"sh", "-c", "echo about to fail; exit 2"}, Interval: 60, EnabledOn: []linkState{linkBATS}},
+    }})
+    defer services.stopAll()
+    time.Sleep(500 * time.Millisecond)
+
+    w := httptest.NewRecorder()
+    servicesHandle(w, httptest.NewRequest("GET", "/services/chatty/runs", nil))
+    var runs []serviceRun
+    if err := json.Unmarshal(w.Body.Bytes(), &runs); err != nil {
+        t.Fatalf("Could not decode runs %s: %s", w.Body.String(), err)
+    }
+    if len(runs) != 1 || runs[0].ID != 1 || runs[0].ExitCode == nil || *runs[0].ExitCode != 2 || runs[0].Finished.IsZero() || runs[0].OutputBytes != 14 {
+        t.Fatalf("Unexpected runs: %s", w.Body.String())
+    }
+
+    w = httptest.NewRecorder()
+    servicesHandle(w, httptest.NewRequest("GET", "/services/chatty/runs/1/output", nil))
+    if w.Body.String() != "about to fail\n" {
+        t.Errorf("Unexpected run output: %q", w.Body.String())
+    }
+
+    for _, path := range []string{"/services/quiet/runs", "/services/chatty/runs/2/output", "/services/chatty/runs/x/output", "/services/chatty"} {
+        w = httptest.NewRecorder()
+        servicesHandle(w, httptest.NewRequest("GET", path, nil))
+        if w.Code != 404 || strings.HasPrefix(w.Body.String(), "[") {
+            t.Errorf("%s should be a 404, got %d", path, w.Code)
+        }
+    }
+}
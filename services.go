@@ -0,0 +1,547 @@
+package main
+
+import (
+  "log/slog"
+  "sync"
+  "time"
+  "reflect"
+  "sort"
+  "context"
+  "errors"
+  "fmt"
+  rand "math/rand"
+  exec "os/exec"
+)
+
+/*
+**  managedService - one service management go routine, as seen by the
+**                   service manager and the status server
+**    config    - as started, never changed so the go routine can read it
+**    interval  - the interval last handed over retune, manager only
+**    state     - the link status and run status, shared under its lock
+**    history   - the service's recent runs and their output
+**    retune    - new interval in seconds, taken without restarting
+**    ctx       - cancelled when the service should stop after the current run
+**    runCtx    - context external commands run under, cancelling it kills them
+**    done      - closed by the service go routine when it has stopped
+**    previous  - done chan of the service this one replaced, if any
+*/
+type managedService struct {
+    config      serviceConfig
+    interval    int
+    state       *serviceState
+    history     *runHistory
+    retune      chan int
+    ctx         context.Context
+    stop        context.CancelFunc
+    runCtx      context.Context
+    done        chan bool
+    previous    chan bool
+}
+
+func newManagedService(runCtx context.Context, svc serviceConfig) *managedService {
+    ctx, stop := context.WithCancel(runCtx)
+    return &managedService{
+        config:     svc,
+        interval:   svc.Interval,
+        state:      &serviceState{changed: make(chan bool, 1)},
+        history:    &runHistory{},
+        retune:     make(chan int, 1),
+        ctx:        ctx,
+        stop:       stop,
+        runCtx:     runCtx,
+        done:       make(chan bool),
+    }
+}
+
+/*
+**  serviceStatus - what a service is doing, for the status server
+*/
+type serviceStatus struct {
+    Name            string      `json:"name"`
+    Kind            string      `json:"kind"`
+    Enabled         bool        `json:"enabled"`
+    Running         bool        `json:"running"`
+    Started         time.Time   `json:"started,omitzero"`
+    LastExit        *int        `json:"lastExit,omitempty"`
+    LastDuration    float64     `json:"lastDurationSeconds,omitempty"`
+    LastError       string      `json:"lastError,omitempty"`
+    NextRun         time.Time   `json:"nextRun,omitzero"`
+    ConsecutiveFailures int     `json:"consecutiveFailures,omitempty"`
+    Backoff         float64     `json:"backoffSeconds,omitempty"`
+    Failed          bool        `json:"failed,omitempty"`
+    Shovels         []shovelStatus  `json:"shovels,omitempty"`
+}
+
+/*
+**  serviceState - the latest link status handed to a service and its run
+**                 status.  written by the service go routine and the
+**                 manager, read directly by the status server
+**    changes   - count of link state changes
+**    seen      - changes as of the link the service last read
+**    failedAt  - seen when the service gave up
+**    changed   - signalled on a link state change
+*/
+type serviceState struct {
+    sync.Mutex
+    link        linkStatus
+    status      serviceStatus
+    changes     int
+    seen        int
+    failedAt    int
+    changed     chan bool
+}
+
+func (s *serviceState) setLink(status linkStatus) {
+    s.Lock()
+    defer s.Unlock()
+    if status.State != s.link.State {
+        s.changes++
+        select {
+        case s.changed <- true:
+        default:
+        }
+    }
+    s.link = status
+}
+
+func (s *serviceState) currentLink() linkStatus {
+    s.Lock()
+    defer s.Unlock()
+    s.seen = s.changes
+    return s.link
+}
+
+func (s *serviceState) update(update func(*serviceStatus)) {
+    s.Lock()
+    defer s.Unlock()
+    update(&s.status)
+}
+
+func (s *serviceState) snapshot() serviceStatus {
+    s.Lock()
+    defer s.Unlock()
+    return s.status
+}
+
+/*
+**  begin - records the start of a run.  the run's output goes to
+**          run.output
+*/
+func (ms *managedService) begin() *serviceRun {
+    started := time.Now()
+    ms.state.update(func(s *serviceStatus) {
+        s.Running = true
+        s.Started = started
+        s.NextRun = time.Time{}
+    })
+    return ms.history.begin(started)
+}
+
+/*
+**  finish - records the end of run
+*/
+func (ms *managedService) finish(run *serviceRun, err error) {
+    finished := time.Now()
+    duration := finished.Sub(run.Started)
+    ms.history.finish(run, finished, err)
+    metrics.serviceRan(ms.config.Name, duration, err)
+    args := []any{"service", ms.config.Name, "run", run.ID, "duration", duration}
+    if code := exitCode(err); code != nil {
+        args = append(args, "exit_code", *code)
+    }
+    if errors.Is(err, errRunTimeout) {
+        slog.Warn("Run timed out", append(args, "timeout", time.Duration(ms.config.Timeout) * time.Second, "error", err)...)
+    } else if err != nil {
+        slog.Warn("Run failed", append(args, "error", err)...)
+    } else {
+        slog.Debug("Run finished", args...)
+    }
+    failures := 0
+    ms.state.update(func(s *serviceStatus) {
+        s.Running = false
+        s.LastDuration = duration.Seconds()
+        s.LastExit = exitCode(err)
+        s.LastError = ""
+        s.ConsecutiveFailures++
+        if err == nil {
+            s.ConsecutiveFailures = 0
+        } else {
+            s.LastError = err.Error()
+        }
+        failures = s.ConsecutiveFailures
+    })
+
+    if retry := ms.config.Retry; retry != nil && retry.GiveUpAfter > 0 && failures >= retry.GiveUpAfter {
+        slog.Error("Giving up until the link changes", "service", ms.config.Name, "failures", failures)
+        ms.state.Lock()
+        ms.state.status.Failed = true
+        ms.state.failedAt = ms.state.seen
+        ms.state.Unlock()
+    }
+}
+
+//  errRunTimeout - cause of a run killed for going past the service's timeout
+var errRunTimeout = errors.New("timed out")
+
+/*
+**  runContext - the context one run goes under.  it is cancelled with
+**               errRunTimeout once the service's timeout passes
+*/
+func (ms *managedService) runContext() (context.Context, context.CancelFunc) {
+    if ms.config.Timeout > 0 {
+        timeout := time.Duration(ms.config.Timeout) * time.Second
+        return context.WithTimeoutCause(ms.runCtx, timeout, errRunTimeout)
+    }
+    return context.WithCancel(ms.runCtx)
+}
+
+/*
+**  timedOut - err marked as a timeout if ctx, from runContext, timed out
+*/
+func timedOut(ctx context.Context, err error) error {
+    if err != nil && context.Cause(ctx) == errRunTimeout {
+        return fmt.Errorf("%w: %w", errRunTimeout, err)
+    }
+    return err
+}
+
+/*
+**  exitCode - the exit code behind err, nil if it wasn't a command exiting
+*/
+func exitCode(err error) *int {
+    code := 0
+    var exitErr *exec.ExitError
+    if errors.As(err, &exitErr) {
+        code = exitErr.ExitCode()
+    } else if err != nil {
+        return nil
+    }
+    return &code
+}
+
+/*
+**  wait - sleeps for interval seconds, or backs off after failed runs if
+**         the service has a retry policy.  picks up a retuned interval
+**         while sleeping and returns false if the service was stopped
+*/
+func (ms *managedService) wait(interval *int) bool {
+    if ms.state.snapshot().Failed {
+        return ms.ctx.Err() == nil  //  waitIfFailed does the waiting
+    }
+    start := time.Now()
+    next := func() time.Time {
+        delay := time.Duration(*interval) * time.Second
+        backoff := 0.0
+        ms.state.update(func(s *serviceStatus) {
+            if ms.config.Retry != nil && s.ConsecutiveFailures > 0 {
+                delay = ms.config.Retry.backoff(*interval, s.ConsecutiveFailures, rand.Float64())
+                backoff = delay.Seconds()
+            }
+            s.NextRun = start.Add(delay)
+            s.Backoff = backoff
+        })
+        return start.Add(delay)
+    }
+    timer := time.NewTimer(time.Until(next()))
+    defer timer.Stop()
+    for {
+        select {
+        case <-ms.ctx.Done():
+            return false
+        case *interval = <-ms.retune:
+            timer.Reset(time.Until(next()))
+        case <-timer.C:
+            return true
+        }
+    }
+}
+
+/*
+**  waitIfFailed - blocks while the service has given up, until the link
+**                 changes from the one its last run acted on.  returns
+**                 false if the service was stopped while waiting
+*/
+func (ms *managedService) waitIfFailed() bool {
+    for {
+        ms.state.Lock()
+        failed := ms.state.status.Failed
+        retry := failed && ms.state.changes != ms.state.failedAt
+        if retry {
+            ms.state.status.Failed = false
+            ms.state.status.ConsecutiveFailures = 0
+            ms.state.status.Backoff = 0
+        } else if failed {
+            ms.state.status.NextRun = time.Time{}
+        }
+        ms.state.Unlock()
+
+        if retry {
+            slog.Info("Link changed, trying again", "service", ms.config.Name)
+        }
+        if !failed || retry {
+            return true
+        }
+        select {
+        case <-ms.state.changed:
+        case <-ms.ctx.Done():
+            return false
+        }
+    }
+}
+
+/*
+**  waitForPrevious - blocks until the service this one replaced has finished
+**                    its last run.  returns false if stopped while waiting
+*/
+func (ms *managedService) waitForPrevious() bool {
+    if ms.previous == nil {
+        return true
+    }
+    select {
+    case <-ms.previous:
+        return true
+    case <-ms.ctx.Done():
+        return false
+    }
+}
+
+/*
+**  serviceManager - owns the running service go routines.  applies config
+**                   changes and fans link status out to every service.
+**                   cancelling runCtx kills every running command
+*/
+type serviceManager struct {
+    sync.Mutex
+    runCtx      context.Context
+    services    map[string] *managedService
+    retired     []*managedService  //  stopped, but may still be finishing a run
+    histories   map[string] *runHistory  //  by service name, kept across restarts
+    lastStatus  linkStatus
+    haveStatus  bool
+    stopping    bool  //  stopAll has run, config changes are ignored
+}
+
+func newServiceManager(runCtx context.Context) *serviceManager {
+    return &serviceManager{runCtx: runCtx, services: make(map[string] *managedService), histories: make(map[string] *runHistory)}
+}
+
+/*
+**  history - the run history of service name, created if create is set.
+**            nil if there is none
+*/
+func (m *serviceManager) history(name string, create bool) *runHistory {
+    m.Lock()
+    defer m.Unlock()
+    return m.historyLocked(name, create)
+}
+
+func (m *serviceManager) historyLocked(name string, create bool) *runHistory {
+    if m.histories[name] == nil && create {
+        m.histories[name] = &runHistory{}
+    }
+    return m.histories[name]
+}
+
+/*
+**  apply - diffs cfg against the running services.  removed services are
+**          stopped, new ones started, interval changes are handed to the
+**          running go routine and any other change restarts the service
+**          once its current run is done.  does nothing once stopAll has
+**          run, a late reload must not restart services mid shutdown
+*/
+func (m *serviceManager) apply(cfg *relayConfig) {
+    m.Lock()
+    defer m.Unlock()
+    if m.stopping {
+        slog.Warn("Ignoring config change, services are stopping")
+        return
+    }
+
+    wanted := make(map[string] serviceConfig, len(cfg.Services))
+    for _, svc := range cfg.Services {
+        wanted[svc.Name] = svc
+    }
+
+    for name, ms := range m.services {
+        svc, keep := wanted[name]
+        delete(wanted, name)
+        if !keep {
+            slog.Info("Stopping removed service", "service", name)
+            m.stop(name)
+            continue
+        }
+
+        retuned := ms.config
+        retuned.Interval = svc.Interval
+        if !reflect.DeepEqual(retuned, svc) {
+            slog.Info("Restarting changed service", "service", name)
+            m.stop(name)
+            m.start(svc, ms.done)
+        } else if ms.interval != svc.Interval {
+            slog.Info("Changing service interval", "service", name, "from", ms.interval, "interval", svc.Interval)
+            select {
+            case <-ms.retune:
+            default:
+            }
+            ms.retune <- svc.Interval
+            ms.interval = svc.Interval
+        }
+    }
+
+    for _, svc := range cfg.Services {
+        if _, added := wanted[svc.Name]; added {
+            slog.Info("Starting service", "service", svc.Name)
+            m.start(svc, nil)
+        }
+    }
+}
+
+/*
+**  start - launches the management go routine for svc.  caller holds the lock
+*/
+func (m *serviceManager) start(svc serviceConfig, previous chan bool) {
+    ms := newManagedService(m.runCtx, svc)
+    ms.history = m.historyLocked(svc.Name, true)
+    ms.previous = previous
+    if m.haveStatus {
+        ms.state.setLink(m.lastStatus)
+    }
+    m.services[svc.Name] = ms
+    startService(svc, ms)
+}
+
+/*
+**  stop - tells a service to stop after its current run.  caller holds the lock
+*/
+func (m *serviceManager) stop(name string) {
+    ms := m.services[name]
+    ms.stop()
+    delete(m.services, name)
+    m.retired = append(m.retired, ms)
+}
+
+/*
+**  stopAll - tells every service to stop after its current run.  later
+**            calls to apply are ignored
+*/
+func (m *serviceManager) stopAll() {
+    m.Lock()
+    defer m.Unlock()
+    m.stopping = true
+    for name := range m.services {
+        m.stop(name)
+    }
+}
+
+/*
+**  waitStopped - blocks until every stopped service has finished its last run
+*/
+func (m *serviceManager) waitStopped() {
+    m.Lock()
+    retired := m.retired
+    m.Unlock()
+
+    for _, ms := range retired {
+        <-ms.done
+    }
+}
+
+/*
+**  publish - hands the latest link status to every service
+*/
+func (m *serviceManager) publish(status linkStatus) {
+    m.Lock()
+    defer m.Unlock()
+    m.lastStatus = status
+    m.haveStatus = true
+    for _, ms := range m.services {
+        ms.state.setLink(status)
+    }
+}
+
+/*
+**  status - the last link status published, false if there hasn't been one
+*/
+func (m *serviceManager) status() (linkStatus, bool) {
+    m.Lock()
+    defer m.Unlock()
+    return m.lastStatus, m.haveStatus
+}
+
+/*
+**  statuses - the run status of every active service, sorted by name, and
+**             whether each is enabled on the last published link
+*/
+func (m *serviceManager) statuses() []serviceStatus {
+    m.Lock()
+    defer m.Unlock()
+    names := make([]string, 0, len(m.services))
+    for name := range m.services {
+        names = append(names, name)
+    }
+    sort.Strings(names)
+
+    statuses := make([]serviceStatus, 0, len(names))
+    for _, name := range names {
+        ms := m.services[name]
+        status := ms.state.snapshot()
+        status.Name = name
+        status.Kind = ms.config.Kind
+        status.Enabled = m.haveStatus && ms.config.active(m.lastStatus)
+        statuses = append(statuses, status)
+    }
+    return statuses
+}
+
+/*
+**  running - true if any service, including stopped ones that have not
+**            finished yet, has an external command running
+*/
+func (m *serviceManager) running() bool {
+    return len(m.runningNames()) > 0
+}
+
+/*
+**  runningNames - sorted names of the services, active or retired, with a
+**                 command running
+*/
+func (m *serviceManager) runningNames() []string {
+    m.Lock()
+    defer m.Unlock()
+    seen := make(map[string] bool)
+    for name, ms := range m.services {
+        if ms.running() {
+            seen[name] = true
+        }
+    }
+
+    //  a fresh slice, waitStopped may be walking the old one unlocked
+    retired := make([]*managedService, 0, len(m.retired))
+    for _, ms := range m.retired {
+        select {
+        case <-ms.done:
+            continue
+        default:
+        }
+        if ms.running() {
+            seen[ms.config.Name] = true
+        }
+        retired = append(retired, ms)
+    }
+    m.retired = retired
+
+    names := make([]string, 0, len(seen))
+    for name := range seen {
+        names = append(names, name)
+    }
+    sort.Strings(names)
+    return names
+}
+
+/*
+**  running - is the service's command running
+*/
+func (ms *managedService) running() bool {
+    return ms.state.snapshot().Running
+}
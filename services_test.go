@@ -0,0 +1,135 @@
+package main
+
+import (
+    ioutil "io/ioutil"
+    "testing"
+    "os"
+    "time"
+    "context"
+)
+
+func TestServiceManagerApply(t *testing.T) {
+    a := serviceConfig{Name: "a", Kind: serviceCI, Command: []string{"true"}, Interval: 1, EnabledOn: []linkState{linkBATS}}
+    b := serviceConfig{Name: "b", Kind: serviceToggle, Command: []string{"true"}, Interval: 1, EnabledOn: []linkState{linkBATS}}
+    c := serviceConfig{Name: "c", Kind: serviceCI, Command: []string{"true"}, Interval: 1, EnabledOn: []linkState{linkVSAT}}
+
+    manager := newServiceManager(context.Background())
+    manager.apply(&relayConfig{Services: []serviceConfig{a, b}})
+    oldA := manager.services["a"]
+    oldB := manager.services["b"]
+
+    //  retune a, drop b, add c
+    a.Interval = 30
+    manager.apply(&relayConfig{Services: []serviceConfig{a, c}})
+
+    if manager.services["a"] == oldA && manager.services["a"].interval == 30 {
+        t.Log("a was retuned in place")
+    } else {
+        t.Error("a should have been retuned without a restart")
+    }
+    if _, ok := manager.services["b"]; ok {
+        t.Error("b should have been removed")
+    }
+    <-oldB.done
+    if _, ok := manager.services["c"]; !ok {
+        t.Error("c should have been started")
+    }
+
+    //  any other change restarts the service
+    a.Command = []string{"false"}
+    manager.apply(&relayConfig{Services: []serviceConfig{a, c}})
+    if manager.services["a"] != oldA && manager.services["a"].previous == oldA.done {
+        t.Log("a was restarted after the old one finished")
+    } else {
+        t.Error("a should have been restarted for a command change")
+    }
+
+    manager.stopAll()
+    manager.waitStopped()
+    if manager.running() {
+        t.Error("nothing should be running after stopping everything")
+    }
+}
+
+func TestReloadKeepsConfigOnError(t *testing.T) {
+    path := writeConfig(`{"services": [{"name": "a", "kind": "ci", "command": ["true"], "interval": 5}]}`, t)
+    defer os.Remove(path)
+    configFile = &path
+
+    shutdown = &shutdownProgress{}
+    services = newServiceManager(context.Background())
+    monitor = newLinkMonitor(nil, monitorConfig{Interval: 5}, services)
+    err := reloadConfig()
+    if err != nil {
+        t.Fatalf("reload of a good config failed with: %s", err)
+    }
+
+    ioutil.WriteFile(path, []byte(`{"services": [{"name": "b", "kind": "sometimes"}]}`), 0644)
+    err = reloadConfig()
+    if err == nil {
+        t.Error("reload of a bad config should have failed")
+    }
+    if _, ok := services.services["a"]; ok {
+        t.Log("service a kept running after a bad reload")
+    } else {
+        t.Error("bad reload dropped the running services")
+    }
+
+    services.stopAll()
+    empty := ""
+    configFile = &empty
+}
+
+func TestReloadRefusedWhileShuttingDown(t *testing.T) {
+    path := writeConfig(`{"services": [{"name": "a", "kind": "ci", "command": ["true"], "interval": 5}]}`, t)
+    defer os.Remove(path)
+    configFile = &path
+
+    shutdown = &shutdownProgress{}
+    services = newServiceManager(context.Background())
+    monitor = newLinkMonitor(nil, monitorConfig{Interval: 5}, services)
+    shutdown.begin(quitDrain, time.Now().Add(time.Minute))
+    if err := reloadConfig(); err != errShuttingDown {
+        t.Errorf("Expected reload to be refused while shutting down, got %v", err)
+    }
+    if len(services.services) != 0 {
+        t.Error("a refused reload should not have started anything")
+    }
+
+    //  a reload already past the check must not restart stopped services
+    services.stopAll()
+    cfg, _ := loadConfig(path)
+    services.apply(cfg)
+    if len(services.services) != 0 {
+        t.Error("apply after stopAll should not have started anything")
+    }
+
+    shutdown = &shutdownProgress{}
+    empty := ""
+    configFile = &empty
+}
+
+func TestServiceGivesUpUntilLinkChanges(t *testing.T) {
+    ctx, cancel := context.WithCancel(context.Background())
+    defer cancel()
+    manager := newServiceManager(ctx)
+    manager.publish(linkStatus{State: linkBATS})
+    manager.apply(&relayConfig{Services: []serviceConfig{
+        {Name: "broken", Kind: serviceCI, Command: []string{"false"}, Interval: 1, EnabledOn: []linkState{linkBATS, linkLTE},
+            Retry: &retryConfig{GiveUpAfter: 2}},
+    }})
+    defer manager.stopAll()
+
+    time.Sleep(2500 * time.Millisecond)
+    status := manager.statuses()[0]
+    if runs := manager.history("broken", false).list(); len(runs) != 2 || !status.Failed || !status.NextRun.IsZero() {
+        t.Fatalf("Expected 2 runs then giving up, got %d runs and status %+v", len(runs), status)
+    }
+
+    manager.publish(linkStatus{State: linkLTE})
+    time.Sleep(500 * time.Millisecond)
+    status = manager.statuses()[0]
+    if runs := manager.history("broken", false).list(); len(runs) != 3 || status.Failed || status.ConsecutiveFailures != 1 {
+        t.Errorf("Expected a fresh run after the link changed, got %d runs and status %+v", len(runs), status)
+    }
+}
@@ -0,0 +1,486 @@
+package main
+
+import (
+  "io"
+  ioutil "io/ioutil"
+  "fmt"
+  "bytes"
+  "errors"
+  "strings"
+  "context"
+  "log/slog"
+  "time"
+  json "encoding/json"
+)
+
+//  where a toggle service reads its shovel's state from
+const (
+    shovelInitScript    = "initscript"   //  the command's status, LSB exit codes
+    shovelRabbitmqctl   = "rabbitmqctl"  //  rabbitmqctl shovel_status
+    shovelManagementAPI = "management"   //  the rabbitmq management api, no command
+    shovelStartStop     = "startstop"    //  not read, the command only takes start and stop
+)
+
+//  seconds between checks of a shovel that should already be as wanted,
+//  if reconcile isn't set
+const defaultReconcile = 300
+
+//  returned by a backend that has no way of reading the shovel's state
+var errNoState = errors.New("shovel state can not be read")
+
+//  returned when a shovel whose state can't be read may not have changed
+var errUnconfirmed = errors.New("shovel state not confirmed")
+
+//  rabbitmqctl - the rabbitmqctl the rabbitmqctl backend runs
+var rabbitmqctl = "rabbitmqctl"
+
+/*
+**  shovelBackend - reads and changes the actual state of a shovel.  output
+**                  gets anything worth keeping in the run history
+*/
+type shovelBackend interface {
+    State(ctx context.Context, output io.Writer) (running bool, err error)
+    Start(ctx context.Context, output io.Writer) error
+    Stop(ctx context.Context, output io.Writer) error
+}
+
+/*
+**  newShovelBackend - the backend svc is configured for, for one of its
+**                     shovels
+*/
+func newShovelBackend(svc serviceConfig, shovel shovelConfig) shovelBackend {
+    script := &initScript{command: shovel.Command, grace: svc.killGrace()}
+    switch svc.Backend {
+    case shovelRabbitmqctl:
+        return &rabbitmqctlShovel{initScript: script, name: shovel.Name}
+    case shovelStartStop:
+        return &startStopScript{initScript: script}
+    case shovelManagementAPI:
+        config := *svc.Management
+        config.Definition = shovel.Definition
+        return newManagementShovel(shovel.Name, config)
+    }
+    return script
+}
+
+/*
+**  shovelStatus - what one of a service's shovels is doing, for the
+**                 status server.  State is empty until it has been read
+*/
+type shovelStatus struct {
+    Name        string      `json:"name"`
+    Priority    int         `json:"priority,omitempty"`
+    Enabled     bool        `json:"enabled"`
+    State       string      `json:"state,omitempty"`
+    Checked     time.Time   `json:"checked,omitzero"`
+    Error       string      `json:"error,omitempty"`
+    QueueDepth  *int        `json:"queueDepth,omitempty"`
+}
+
+/*
+**  managedShovel - one shovel of a toggle service
+**    want     - whether it was last wanted running
+**    settled  - the last check left it as wanted
+**    depth    - reads its queue's depth, nil without a queue policy
+**    measured - when depth was last read
+*/
+type managedShovel struct {
+    config      shovelConfig
+    backend     shovelBackend
+    want        bool
+    settled     bool
+    status      shovelStatus
+    depth       func(ctx context.Context, output io.Writer) (int, error)
+    measured    time.Time
+}
+
+/*
+**  shovelSet - the shovels of a toggle service, highest priority first.
+**              a shovel is only touched when the link calls for a change,
+**              its last check failed or every has passed since it was last
+**              checked for drift
+*/
+type shovelSet struct {
+    svc         serviceConfig
+    every       time.Duration
+    shovels     []*managedShovel
+}
+
+func newShovelSet(svc serviceConfig) *shovelSet {
+    set := &shovelSet{svc: svc, every: time.Duration(svc.Reconcile) * time.Second}
+    if set.every == 0 {
+        set.every = defaultReconcile * time.Second
+    }
+    for _, shovel := range svc.shovels() {
+        managed := &managedShovel{
+            config:     shovel,
+            backend:    newShovelBackend(svc, shovel),
+            status:     shovelStatus{Name: shovel.Name, Priority: shovel.Priority},
+        }
+        if shovel.Queue != nil {
+            queue := shovel.Queue.Name
+            if management, ok := managed.backend.(*managementShovel); ok {
+                managed.depth = func(ctx context.Context, output io.Writer) (int, error) {
+                    return management.queueDepth(ctx, output, queue)
+                }
+            } else {
+                managed.depth = func(ctx context.Context, output io.Writer) (int, error) {
+                    return rabbitmqctlQueueDepth(ctx, output, svc.killGrace(), queue)
+                }
+            }
+        }
+        set.shovels = append(set.shovels, managed)
+    }
+    return set
+}
+
+/*
+**  measure - reads the queue depth of every shovel with a queue policy
+**            whose last read is more than its interval ago.  a depth that
+**            can't be read is unknown and the shovel goes by the link alone
+*/
+func (set *shovelSet) measure(ctx context.Context, now time.Time, logger *slog.Logger) {
+    for _, shovel := range set.shovels {
+        if shovel.depth == nil {
+            continue
+        }
+        interval := time.Duration(shovel.config.Queue.Interval) * time.Second
+        if interval == 0 {
+            interval = defaultQueueInterval * time.Second
+        }
+        if !shovel.measured.IsZero() && now.Sub(shovel.measured) < interval {
+            continue
+        }
+
+        shovel.measured = now
+        depth, err := shovel.depth(ctx, ioutil.Discard)
+        if err != nil {
+            logger.Warn("Could not read queue depth", "shovel", shovel.config.Name, "queue", shovel.config.Queue.Name, "error", err)
+            shovel.status.QueueDepth = nil
+            continue
+        }
+        shovel.status.QueueDepth = &depth
+    }
+}
+
+/*
+**  wanted - should shovel be running on the link in status.  with a queue
+**           policy and a known depth, a short queue keeps it from starting
+**           and a backlog starts it on the policy's extra links too.  what
+**           is already running goes by the state last read from the
+**           backend, or by what was last wanted and left that way if the
+**           backend can't read it
+*/
+func (set *shovelSet) wanted(shovel *managedShovel, status linkStatus) bool {
+    on := set.svc.decideShovel(shovel.config, status)
+    policy, depth := shovel.config.Queue, shovel.status.QueueDepth
+    if policy == nil || depth == nil {
+        return on
+    }
+
+    backlog := policy.StartAbove > 0 && set.svc.decideShovel(shovelConfig{EnabledOn: policy.AlsoOn}, status)
+    running := shovel.status.State == shovelState(true)
+    if shovel.status.State == "" {
+        running = shovel.want && shovel.settled
+    }
+    if running {
+        return on || (backlog && *depth > policy.SkipBelow)
+    }
+    return (on && *depth >= policy.SkipBelow) || (backlog && *depth > policy.StartAbove)
+}
+
+func (set *shovelSet) due(shovel *managedShovel, status linkStatus, now time.Time) bool {
+    return !shovel.settled || set.wanted(shovel, status) != shovel.want || now.Sub(shovel.status.Checked) >= set.every
+}
+
+/*
+**  pending - true if any shovel is due a check
+*/
+func (set *shovelSet) pending(status linkStatus, now time.Time) bool {
+    for _, shovel := range set.shovels {
+        if set.due(shovel, status, now) {
+            return true
+        }
+    }
+    return false
+}
+
+/*
+**  reconcile - checks every shovel that is due, stopping the ones no
+**              longer wanted, lowest priority first, before starting the
+**              ones that are, highest priority first.  returns every
+**              shovel's error
+*/
+func (set *shovelSet) reconcile(ctx context.Context, status linkStatus, output io.Writer, logger *slog.Logger) error {
+    //  a queue policy needs to know what is already running before it
+    //  decides, a shovel left running before a restart is not stopped
+    for _, shovel := range set.shovels {
+        if shovel.config.Queue != nil && shovel.status.State == "" {
+            running, err := shovel.backend.State(ctx, output)
+            if err == nil {
+                shovel.status.State = shovelState(running)
+            }
+        }
+    }
+
+    now := time.Now()
+    var due []*managedShovel
+    for i := len(set.shovels) - 1; i >= 0; i-- {
+        if shovel := set.shovels[i]; set.due(shovel, status, now) && !set.wanted(shovel, status) {
+            due = append(due, shovel)
+        }
+    }
+    for _, shovel := range set.shovels {
+        if set.due(shovel, status, now) && set.wanted(shovel, status) {
+            due = append(due, shovel)
+        }
+    }
+
+    var errs []error
+    for _, shovel := range due {
+        wanted := set.wanted(shovel, status)
+        shovelLogger := logger.With("shovel", shovel.config.Name)
+        if depth := shovel.status.QueueDepth; depth != nil {
+            shovelLogger = shovelLogger.With("queue_depth", *depth)
+        }
+        shovelLogger.Debug("Checking shovel", "want", shovelState(wanted))
+        fmt.Fprintf(output, "== %s, want %s\n", shovel.config.Name, shovelState(wanted))
+        state, err := reconcileShovel(ctx, shovel.backend, wanted, shovel.settled && wanted == shovel.want, output, shovelLogger)
+        if errors.Is(err, errUnconfirmed) {
+            //  most likely already that way, shown but not retried
+            shovel.status.Error = fmt.Sprintf("shovel %s: %s", shovel.config.Name, err)
+            err = nil
+        } else if err != nil {
+            err = fmt.Errorf("shovel %s: %w", shovel.config.Name, err)
+            errs = append(errs, err)
+            shovel.status.Error = err.Error()
+        } else {
+            shovel.status.Error = ""
+        }
+        shovel.want, shovel.settled = wanted, err == nil
+        shovel.status.Enabled = wanted
+        shovel.status.State = state
+        shovel.status.Checked = time.Now()
+    }
+    return errors.Join(errs...)
+}
+
+/*
+**  statuses - every shovel's status, highest priority first
+*/
+func (set *shovelSet) statuses() []shovelStatus {
+    statuses := make([]shovelStatus, 0, len(set.shovels))
+    for _, shovel := range set.shovels {
+        statuses = append(statuses, shovel.status)
+    }
+    return statuses
+}
+
+/*
+**  initScript - an init script taking start, stop and status.  status
+**               exits 0 while running and 1 to 3 when not, as LSB has it
+*/
+type initScript struct {
+    command []string
+    grace   time.Duration
+}
+
+func (s *initScript) run(ctx context.Context, output io.Writer, action string) error {
+    argv := append(append([]string{}, s.command...), action)
+    fmt.Fprintf(output, "$ %s\n", strings.Join(argv, " "))
+    return runCommand(ctx, argv, output, s.grace)
+}
+
+func (s *initScript) State(ctx context.Context, output io.Writer) (bool, error) {
+    err := s.run(ctx, output, "status")
+    code := exitCode(err)
+    switch {
+    case code == nil:
+        return false, err
+    case *code == 0:
+        return true, nil
+    case *code <= 3:
+        return false, nil
+    }
+    return false, fmt.Errorf("unknown shovel status: %w", err)
+}
+
+func (s *initScript) Start(ctx context.Context, output io.Writer) error {
+    return s.run(ctx, output, "start")
+}
+
+func (s *initScript) Stop(ctx context.Context, output io.Writer) error {
+    return s.run(ctx, output, "stop")
+}
+
+/*
+**  startStopScript - an init script taking only start and stop, as the
+**                    default shovel service's always has.  its state can't
+**                    be read, starting a started shovel or stopping a
+**                    stopped one just fails harmlessly
+*/
+type startStopScript struct {
+    *initScript
+}
+
+func (s *startStopScript) State(ctx context.Context, output io.Writer) (bool, error) {
+    return false, errNoState
+}
+
+/*
+**  rabbitmqctlShovel - an init script's start and stop, with the state of
+**                      shovel name read from rabbitmqctl shovel_status.  a
+**                      shovel still starting counts as running, one that
+**                      isn't listed as stopped
+*/
+type rabbitmqctlShovel struct {
+    *initScript
+    name    string
+}
+
+func (s *rabbitmqctlShovel) State(ctx context.Context, output io.Writer) (bool, error) {
+    var shovels []struct {
+        Name    string  `json:"name"`
+        State   string  `json:"state"`
+    }
+    err := runRabbitmqctl(ctx, output, s.grace, &shovels, "shovel_status")
+    if err != nil {
+        return false, err
+    }
+    for _, shovel := range shovels {
+        if shovel.Name == s.name {
+            return shovel.State == "running" || shovel.State == "starting", nil
+        }
+    }
+    return false, nil
+}
+
+/*
+**  runRabbitmqctl - runs rabbitmqctl with args, decoding its json output
+**                   into v
+*/
+func runRabbitmqctl(ctx context.Context, output io.Writer, grace time.Duration, v interface{}, args ...string) error {
+    argv := append([]string{rabbitmqctl}, args...)
+    argv = append(argv, "--formatter", "json")
+    fmt.Fprintf(output, "$ %s\n", strings.Join(argv, " "))
+    var stdout bytes.Buffer
+    cmd := newCommand(ctx, argv, grace)
+    cmd.Stdout = io.MultiWriter(&stdout, output)
+    cmd.Stderr = output
+    err := cmd.Run()
+    if err != nil {
+        return err
+    }
+
+    err = json.Unmarshal(stdout.Bytes(), v)
+    if err != nil {
+        return errors.New("could not parse rabbitmqctl " + args[0] + ": " + err.Error())
+    }
+    return nil
+}
+
+/*
+**  rabbitmqctlQueueDepth - messages in queue on the default vhost, from
+**                          rabbitmqctl list_queues
+*/
+func rabbitmqctlQueueDepth(ctx context.Context, output io.Writer, grace time.Duration, queue string) (int, error) {
+    var queues []struct {
+        Name        string  `json:"name"`
+        Messages    int     `json:"messages"`
+    }
+    err := runRabbitmqctl(ctx, output, grace, &queues, "list_queues", "name", "messages")
+    if err != nil {
+        return 0, err
+    }
+    for _, listed := range queues {
+        if listed.Name == queue {
+            return listed.Messages, nil
+        }
+    }
+    return 0, errors.New("no queue " + queue)
+}
+
+/*
+**  reconcileShovel - reads the shovel's state and starts or stops it if
+**                    that isn't want, then checks it took.  drifted is set
+**                    when the shovel was last left as want.  returns the
+**                    state it was left in, empty if that isn't known
+*/
+func reconcileShovel(ctx context.Context, backend shovelBackend, want, drifted bool, output io.Writer, logger *slog.Logger) (state string, err error) {
+    running, err := backend.State(ctx, output)
+    if errors.Is(err, errNoState) {
+        return "", toggleUnread(ctx, backend, want, output, logger)
+    } else if err != nil {
+        return "", fmt.Errorf("could not read shovel state: %w", err)
+    } else if running == want {
+        logger.Debug("Shovel already " + shovelState(want))
+        return shovelState(running), nil
+    }
+
+    if drifted {
+        logger.Warn("Shovel drifted", "found", shovelState(running), "want", shovelState(want))
+    }
+    action := backend.Stop
+    if want {
+        action = backend.Start
+    }
+    err = action(ctx, output)
+    if err != nil {
+        return "", fmt.Errorf("could not %s shovel: %w", shovelVerb(want), err)
+    }
+
+    running, err = backend.State(ctx, output)
+    if err != nil {
+        return "", fmt.Errorf("could not verify shovel state: %w", err)
+    } else if running != want {
+        return shovelState(running), fmt.Errorf("shovel still %s after %s", shovelState(running), shovelVerb(want))
+    }
+    if want {
+        logger.Info("Shovel started")
+    } else {
+        logger.Info("Shovel stopped")
+    }
+    return shovelState(running), nil
+}
+
+/*
+**  toggleUnread - starts or stops a shovel whose state can't be read.  the
+**                 command exiting non-zero is most likely the shovel
+**                 already being that way, it is warned about and left
+**                 unconfirmed.  not running at all, or being killed, is
+**                 an error
+*/
+func toggleUnread(ctx context.Context, backend shovelBackend, want bool, output io.Writer, logger *slog.Logger) error {
+    action := backend.Stop
+    if want {
+        action = backend.Start
+    }
+    err := action(ctx, output)
+    if code := exitCode(err); err != nil && (code == nil || *code < 0 || ctx.Err() != nil) {
+        return fmt.Errorf("could not %s shovel: %w", shovelVerb(want), err)
+    } else if err != nil {
+        logger.Warn("Shovel " + shovelVerb(want) + " failed, taken as already " + shovelState(want), "exit_code", *code, "error", err)
+        return fmt.Errorf("%w, %s exited %d", errUnconfirmed, shovelVerb(want), *code)
+    }
+
+    if want {
+        logger.Info("Shovel started")
+    } else {
+        logger.Info("Shovel stopped")
+    }
+    return nil
+}
+
+func shovelState(running bool) string {
+    if running {
+        return "running"
+    }
+    return "stopped"
+}
+
+func shovelVerb(start bool) string {
+    if start {
+        return "start"
+    }
+    return "stop"
+}
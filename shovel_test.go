@@ -0,0 +1,340 @@
+package main
+
+import (
+    "io"
+    ioutil "io/ioutil"
+    "testing"
+    "strings"
+    "strconv"
+    "os"
+    "time"
+    "errors"
+    "context"
+    "log/slog"
+    filepath "path/filepath"
+)
+
+/*
+**  fakeInitScript - writes an init script to a temp dir that keeps its
+**                   state in a file and logs every call.  given a shovel
+**                   name before the action it keeps that shovel's state
+**                   and logs name:action.  returns its path and a func
+**                   reading the calls so far
+*/
+func fakeInitScript(t *testing.T) (string, func() string) {
+    dir := t.TempDir()
+    script := filepath.Join(dir, "shovel")
+    body := `#!/bin/sh
+dir=$(dirname "$0")
+state="$dir/state"
+if [ $# -eq 2 ]; then
+    state="$dir/$1.state"
+    echo "$1:$2" >> "$dir/calls"
+    shift
+else
+    echo "$1" >> "$dir/calls"
+fi
+case "$1" in
+start) touch "$state" ;;
+stop) rm -f "$state" ;;
+status) [ -f "$state" ] || exit 3 ;;
+*) exit 4 ;;
+esac
+`
+    err := ioutil.WriteFile(script, []byte(body), 0755)
+    if err != nil {
+        t.Fatalf("Failed to write fake init script with %s", err)
+    }
+    return script, func() string {
+        calls, _ := ioutil.ReadFile(filepath.Join(dir, "calls"))
+        return strings.Join(strings.Fields(string(calls)), " ")
+    }
+}
+
+func TestInitScriptState(t *testing.T) {
+    script, _ := fakeInitScript(t)
+    svc := serviceConfig{Command: []string{script}}
+    backend := newShovelBackend(svc, svc.shovels()[0])
+
+    running, err := backend.State(context.Background(), ioutil.Discard)
+    if err != nil || running {
+        t.Errorf("Expected stopped for exit 3, got %t %v", running, err)
+    }
+    backend.Start(context.Background(), ioutil.Discard)
+    running, err = backend.State(context.Background(), ioutil.Discard)
+    if err != nil || !running {
+        t.Errorf("Expected running for exit 0, got %t %v", running, err)
+    }
+
+    unknown := &initScript{command: []string{"sh", "-c", "exit 4", "sh"}}
+    _, err = unknown.State(context.Background(), ioutil.Discard)
+    if err == nil {
+        t.Error("Expected an error for exit 4")
+    }
+}
+
+func TestRabbitmqctlState(t *testing.T) {
+    dir := t.TempDir()
+    fake := filepath.Join(dir, "rabbitmqctl")
+    err := ioutil.WriteFile(fake, []byte(`#!/bin/sh
+case "$1" in
+shovel_status) echo '[{"name":"to-ship","state":"running","type":"static","vhost":"/"},{"name":"from-ship","state":"terminated","type":"static","vhost":"/"}]' ;;
+list_queues) echo '[{"name":"outbound","messages":42},{"name":"audit","messages":0}]' ;;
+esac
+`), 0755)
+    if err != nil {
+        t.Fatalf("Failed to write fake rabbitmqctl with %s", err)
+    }
+    defer func(old string) { rabbitmqctl = old }(rabbitmqctl)
+    rabbitmqctl = fake
+
+    for name, expected := range map[string] bool{"to-ship": true, "from-ship": false, "missing": false} {
+        svc := serviceConfig{Command: []string{"true"}, Backend: shovelRabbitmqctl, Shovel: name}
+        backend := newShovelBackend(svc, svc.shovels()[0])
+        running, err := backend.State(context.Background(), ioutil.Discard)
+        if err != nil || running != expected {
+            t.Errorf("Expected %s running %t, got %t %v", name, expected, running, err)
+        }
+    }
+
+    depth, err := rabbitmqctlQueueDepth(context.Background(), ioutil.Discard, time.Second, "outbound")
+    if err != nil || depth != 42 {
+        t.Errorf("Expected 42 queued, got %d %v", depth, err)
+    }
+    _, err = rabbitmqctlQueueDepth(context.Background(), ioutil.Discard, time.Second, "missing")
+    if err == nil {
+        t.Error("Expected an error for a missing queue")
+    }
+}
+
+/*
+**  stuckShovel - a backend that never leaves stopped
+*/
+type stuckShovel struct {
+    calls   []string
+}
+
+func (s *stuckShovel) State(ctx context.Context, output io.Writer) (bool, error) {
+    s.calls = append(s.calls, "status")
+    return false, nil
+}
+
+func (s *stuckShovel) Start(ctx context.Context, output io.Writer) error {
+    s.calls = append(s.calls, "start")
+    return nil
+}
+
+func (s *stuckShovel) Stop(ctx context.Context, output io.Writer) error {
+    s.calls = append(s.calls, "stop")
+    return errors.New("should not be stopped")
+}
+
+func TestReconcileShovel(t *testing.T) {
+    logger := slog.New(slog.NewTextHandler(ioutil.Discard, nil))
+    stuck := &stuckShovel{}
+    state, err := reconcileShovel(context.Background(), stuck, false, false, ioutil.Discard, logger)
+    if err != nil || state != "stopped" || strings.Join(stuck.calls, " ") != "status" {
+        t.Errorf("Expected only a status check for a shovel already stopped, got %s %v after %v", state, err, stuck.calls)
+    }
+
+    stuck = &stuckShovel{}
+    state, err = reconcileShovel(context.Background(), stuck, true, false, ioutil.Discard, logger)
+    if err == nil || state != "stopped" || strings.Join(stuck.calls, " ") != "status start status" {
+        t.Errorf("Expected a failed start to be caught by the verify, got %s %v after %v", state, err, stuck.calls)
+    }
+}
+
+func TestStartStopShovel(t *testing.T) {
+    logger := slog.New(slog.NewTextHandler(ioutil.Discard, nil))
+    script, calls := fakeInitScript(t)
+    svc := serviceConfig{Command: []string{script}, Backend: shovelStartStop}
+    backend := newShovelBackend(svc, svc.shovels()[0])
+
+    //  never asked for status, and a start that fails is only unconfirmed
+    ioutil.WriteFile(script, []byte("#!/bin/sh\necho \"$1\" >> \"$(dirname \"$0\")/calls\"\nexit 1\n"), 0755)
+    state, err := reconcileShovel(context.Background(), backend, true, false, ioutil.Discard, logger)
+    if !errors.Is(err, errUnconfirmed) || state != "" || calls() != "start" {
+        t.Errorf("Expected only an unconfirmed start, got %q %v after %s", state, err, calls())
+    }
+
+    //  which doesn't fail the run, but shows on the shovel's status
+    svc.Kind, svc.EnabledOn = serviceToggle, []linkState{linkBATS}
+    set := newShovelSet(svc)
+    err = set.reconcile(context.Background(), linkStatus{State: linkBATS}, ioutil.Discard, logger)
+    if status := set.statuses()[0]; err != nil || !set.shovels[0].settled || !strings.Contains(status.Error, "start exited 1") {
+        t.Errorf("Expected a settled shovel showing the failed start, got %v with %+v", err, status)
+    }
+
+    //  a script that can't be run at all is still an error
+    os.Remove(script)
+    if _, err := reconcileShovel(context.Background(), backend, false, false, ioutil.Discard, logger); err == nil {
+        t.Error("Expected a missing script to fail the stop")
+    }
+    if err := defaultConfig().Services[0].validate(); err != nil || defaultConfig().Services[0].Backend != shovelStartStop {
+        t.Errorf("The default shovel service should only start and stop, got %v", err)
+    }
+}
+
+func TestShovelReconciles(t *testing.T) {
+    script, calls := fakeInitScript(t)
+    ctx, cancel := context.WithCancel(context.Background())
+    defer cancel()
+    feeds := newServiceManager(ctx)
+    feeds.publish(linkStatus{State: linkBATS})
+    feeds.apply(&relayConfig{Services: []serviceConfig{
+        {Name: "shovel", Kind: serviceToggle, Command: []string{script}, Interval: 1, Reconcile: 3, EnabledOn: []linkState{linkBATS}},
+    }})
+    defer feeds.stopAll()
+
+    //  started once, then left alone
+    time.Sleep(1500 * time.Millisecond)
+    if got := calls(); got != "status start status" {
+        t.Errorf("Expected the shovel started and verified once, got %s", got)
+    }
+    if status := feeds.statuses()[0]; status.Shovels[0].State != "running" {
+        t.Errorf("Expected the shovel reported running, got %+v", status)
+    }
+
+    //  stopped behind our back, put right on the next reconcile
+    os.Remove(filepath.Join(filepath.Dir(script), "state"))
+    time.Sleep(2500 * time.Millisecond)
+    if got := calls(); got != "status start status status start status" {
+        t.Errorf("Expected the drift to be put right, got %s", got)
+    }
+
+    //  stopped as soon as the link changes
+    feeds.publish(linkStatus{State: linkLTE})
+    time.Sleep(1500 * time.Millisecond)
+    if got := calls(); !strings.HasSuffix(got, "status stop status") {
+        t.Errorf("Expected the shovel stopped for LTE, got %s", got)
+    }
+}
+
+func TestShovelPriorities(t *testing.T) {
+    script, calls := fakeInitScript(t)
+    ctx, cancel := context.WithCancel(context.Background())
+    defer cancel()
+    feeds := newServiceManager(ctx)
+    feeds.publish(linkStatus{State: linkBATS})
+    feeds.apply(&relayConfig{Services: []serviceConfig{
+        {Name: "shovels", Kind: serviceToggle, Command: []string{script}, Interval: 1, EnabledOn: []linkState{linkBATS}, Shovels: []shovelConfig{
+            {Name: "telemetry", Priority: 1},
+            {Name: "billing", Priority: 10, EnabledOn: []linkState{linkBATS, linkVSAT}},
+            {Name: "guest", Priority: 5},
+        }},
+    }})
+    defer feeds.stopAll()
+
+    //  started highest priority first
+    time.Sleep(500 * time.Millisecond)
+    expected := "billing:status billing:start billing:status guest:status guest:start guest:status telemetry:status telemetry:start telemetry:status"
+    if got := calls(); got != expected {
+        t.Errorf("Expected every shovel started by priority, got %s", got)
+    }
+
+    //  only billing ships over vsat, the rest stop lowest priority first
+    feeds.publish(linkStatus{State: linkVSAT})
+    time.Sleep(1500 * time.Millisecond)
+    expected += " telemetry:status telemetry:stop telemetry:status guest:status guest:stop guest:status"
+    if got := calls(); got != expected {
+        t.Errorf("Expected telemetry then guest stopped, got %s", got)
+    }
+
+    var states []string
+    for _, shovel := range feeds.statuses()[0].Shovels {
+        states = append(states, shovel.Name + "=" + shovel.State)
+    }
+    if got := strings.Join(states, " "); got != "billing=running guest=stopped telemetry=stopped" {
+        t.Errorf("Expected each shovel reported by priority, got %s", got)
+    }
+}
+
+func TestShovelQueuePolicy(t *testing.T) {
+    svc := serviceConfig{Name: "shovels", Kind: serviceToggle, Command: []string{"true"}, Shovels: []shovelConfig{
+        {Name: "telemetry", EnabledOn: []linkState{linkBATS}, Queue: &queuePolicy{Name: "outbound", SkipBelow: 10, StartAbove: 500, AlsoOn: []linkState{linkVSAT}}},
+    }}
+    set := newShovelSet(svc)
+    shovel := set.shovels[0]
+    depth := func(d int) *int { return &d }
+
+    for _, c := range []struct {
+        link        linkState
+        depth       *int
+        running     bool
+        expected    bool
+    }{
+        {linkBATS, nil, false, true},           //  unknown depth, link alone
+        {linkVSAT, nil, false, false},
+        {linkBATS, depth(5), false, false},     //  not worth starting
+        {linkBATS, depth(5), true, true},       //  but not stopped once going
+        {linkBATS, depth(10), false, true},
+        {linkVSAT, depth(400), false, false},   //  no backlog yet
+        {linkVSAT, depth(1000), false, true},   //  backlog ships over vsat
+        {linkVSAT, depth(50), true, true},      //  until it is drained
+        {linkVSAT, depth(5), true, false},
+        {linkLTE, depth(100000), false, false}, //  never on links it doesn't list
+    } {
+        shovel.status.QueueDepth = c.depth
+        shovel.status.State = shovelState(c.running)
+        if wanted := set.wanted(shovel, linkStatus{State: c.link}); wanted != c.expected {
+            queued := "unknown"
+            if c.depth != nil {
+                queued = strconv.Itoa(*c.depth)
+            }
+            t.Errorf("On %s with %s queued and running %t expected %t, got %t", c.link, queued, c.running, c.expected, wanted)
+        }
+    }
+
+    //  a backend that can't read the state goes by what was left running
+    shovel.status.State = ""
+    shovel.want, shovel.settled = true, true
+    shovel.status.QueueDepth = depth(5)
+    if !set.wanted(shovel, linkStatus{State: linkBATS}) {
+        t.Error("A shovel left running with an unread state should be left alone with a short queue")
+    }
+    shovel.status.QueueDepth = depth(50)
+    if !set.wanted(shovel, linkStatus{State: linkVSAT}) {
+        t.Error("A shovel left running with an unread state should be kept until the queue is drained")
+    }
+    shovel.settled = false
+    shovel.status.QueueDepth = depth(5)
+    if set.wanted(shovel, linkStatus{State: linkBATS}) {
+        t.Error("A shovel whose start failed should not count as running")
+    }
+}
+
+func TestShovelQueuePolicyKeepsRunningShovel(t *testing.T) {
+    script, calls := fakeInitScript(t)
+    err := ioutil.WriteFile(filepath.Join(filepath.Dir(script), "tele.state"), nil, 0644)
+    if err != nil {
+        t.Fatalf("Failed to mark the shovel running with %s", err)
+    }
+    fake := filepath.Join(t.TempDir(), "rabbitmqctl")
+    err = ioutil.WriteFile(fake, []byte(`#!/bin/sh
+echo '[{"name":"tele.outbound","messages":5}]'
+`), 0755)
+    if err != nil {
+        t.Fatalf("Failed to write fake rabbitmqctl with %s", err)
+    }
+    defer func(old string) { rabbitmqctl = old }(rabbitmqctl)
+    rabbitmqctl = fake
+
+    ctx, cancel := context.WithCancel(context.Background())
+    defer cancel()
+    feeds := newServiceManager(ctx)
+    feeds.publish(linkStatus{State: linkBATS})
+    feeds.apply(&relayConfig{Services: []serviceConfig{
+        {Name: "shovels", Kind: serviceToggle, Command: []string{script}, Interval: 1, EnabledOn: []linkState{linkBATS}, Shovels: []shovelConfig{
+            {Name: "tele", Queue: &queuePolicy{Name: "tele.outbound", SkipBelow: 100}},
+        }},
+    }})
+    defer feeds.stopAll()
+
+    time.Sleep(1500 * time.Millisecond)
+    if got := calls(); strings.Contains(got, "stop") || strings.Contains(got, "start") {
+        t.Errorf("A running shovel with a short queue should be left alone, got %s", got)
+    }
+    if shovel := feeds.statuses()[0].Shovels[0]; shovel.State != "running" {
+        t.Errorf("Expected the shovel still running, got %+v", shovel)
+    }
+}
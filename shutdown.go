@@ -0,0 +1,177 @@
+package main
+
+import (
+  "os"
+  "log/slog"
+  "sync"
+  "time"
+  "errors"
+  "syscall"
+  "context"
+  signal "os/signal"
+)
+
+//  ways of quitting
+const (
+    quitImmediate = "immediate"  //  quit now, even with commands running
+    quitRefuse    = "refuse"     //  quit only if no commands are running
+    quitDrain     = "drain"      //  stop starting commands, quit once running ones finish
+)
+
+/*
+**  shutdownProgress - how far along quitting is, for the status server
+*/
+type shutdownProgress struct {
+    sync.Mutex
+    Mode        string
+    Started     time.Time
+    Deadline    time.Time
+}
+
+var shutdown = &shutdownProgress{}
+
+//  returned by anything refused once a shutdown has begun
+var errShuttingDown = errors.New("zi-relay is shutting down")
+
+/*
+**  begin - records the start of a shutdown.  fails if one is already going
+*/
+func (s *shutdownProgress) begin(mode string, deadline time.Time) error {
+    s.Lock()
+    defer s.Unlock()
+    if s.Mode != "" {
+        return errors.New("zi-relay is already shutting down, mode " + s.Mode)
+    }
+    s.Mode = mode
+    s.Started = time.Now()
+    s.Deadline = deadline
+    notifySystemd("STOPPING=1\nSTATUS=shutting down (" + mode + ")")
+    return nil
+}
+
+func (s *shutdownProgress) report() (mode string, started, deadline time.Time) {
+    s.Lock()
+    defer s.Unlock()
+    return s.Mode, s.Started, s.Deadline
+}
+
+/*
+**  validQuitMode - is mode one of the ways of quitting
+*/
+func validQuitMode(mode string) bool {
+    return mode == quitImmediate || mode == quitRefuse || mode == quitDrain
+}
+
+/*
+**  validSignalMode - can a signal quit in mode.  refusing makes no sense
+**                    for a signal, init will just kill us later
+*/
+func validSignalMode(mode string) bool {
+    return mode == quitImmediate || mode == quitDrain
+}
+
+/*
+**  notifyQuitSignals - SIGTERM, SIGINT and SIGQUIT from now on, for
+**                      quitOnSignal and then forceQuitOnSignal
+*/
+func notifyQuitSignals() chan os.Signal {
+    sigs := make(chan os.Signal, 1)
+    signal.Notify(sigs, syscall.SIGTERM, syscall.SIGINT, syscall.SIGQUIT)
+    return sigs
+}
+
+/*
+**  quitOnSignal - quits on a signal from sigs the way /quit does in mode,
+**                 until ctx is cancelled.  a signal while already
+**                 shutting down quits immediately, or forces the exit if
+**                 main is past quitting
+*/
+func quitOnSignal(ctx context.Context, sigs <-chan os.Signal, mode string, timeout time.Duration) {
+    for {
+        select {
+        case sig := <-sigs:
+            err := shutdown.begin(mode, time.Now().Add(timeout))
+            if err != nil {
+                slog.Warn("Caught signal while shutting down, quitting immediately", "signal", sig.String())
+            } else if mode == quitDrain {
+                slog.Info("Caught signal", "signal", sig.String(), "mode", mode)
+                startDrain(timeout)
+                continue
+            } else {
+                slog.Info("Caught signal", "signal", sig.String(), "mode", mode)
+            }
+
+            select {
+            case quitChan <- true:
+            case <-ctx.Done():
+                if err != nil {
+                    forceQuit(sig)
+                }
+            }
+        case <-ctx.Done():
+            return
+        }
+    }
+}
+
+/*
+**  forceQuitOnSignal - forces the exit on any signal from sigs.  main runs
+**                      it once it is waiting for the services to stop, so
+**                      a signal then doesn't leave commands or the pidfile
+**                      behind
+*/
+func forceQuitOnSignal(sigs <-chan os.Signal) {
+    for sig := range sigs {
+        forceQuit(sig)
+    }
+}
+
+/*
+**  forceQuit - SIGKILLs every command group still due one, removes the
+**              pidfile and exits
+*/
+var forceQuit = func(sig os.Signal) {
+    slog.Warn("Caught signal while stopping, killing running commands", "signal", sig.String())
+    killPendingGroups()
+    remove_pidfile()
+    os.Exit(1)
+}
+
+/*
+**  startDrain - runs drain on its own go routine.  main swaps in one its
+**               WaitGroup tracks, cancelled once it is quitting anyway
+*/
+var startDrain = func(timeout time.Duration) {
+    go drain(context.Background(), timeout)
+}
+
+/*
+**  drain - stops every service launching new runs, waits for the running
+**          ones up to timeout and then quits.  gives up if ctx is cancelled
+*/
+func drain(ctx context.Context, timeout time.Duration) {
+    defer removePidfileOnPanic()
+    slog.Info("Draining, waiting for running commands", "timeout", timeout)
+    services.stopAll()
+
+    deadline := time.Now().Add(timeout)
+    running := services.running()
+    for running && time.Now().Before(deadline) {
+        select {
+        case <-time.After(time.Second):
+        case <-ctx.Done():
+            return
+        }
+        running = services.running()
+    }
+    if running {
+        slog.Warn("Drain deadline passed with commands still running, quitting anyway", "running", services.runningNames())
+    } else {
+        slog.Info("All commands finished, quitting")
+    }
+
+    select {
+    case quitChan <- true:
+    case <-ctx.Done():
+    }
+}
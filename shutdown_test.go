@@ -0,0 +1,214 @@
+package main
+
+import (
+    "testing"
+    "time"
+    "strings"
+    "context"
+    "syscall"
+    "os"
+    ioutil "io/ioutil"
+    httptest "net/http/httptest"
+    signal "os/signal"
+)
+
+func startDrainTest(command string) {
+    quitChan = make(chan bool, 1)
+    shutdown = &shutdownProgress{}
+
+    services = newServiceManager(context.Background())
+    monitor = newLinkMonitor(nil, monitorConfig{Interval: 5}, services)
+    services.publish(linkStatus{State: linkBATS})
+    services.apply(&relayConfig{Services: []serviceConfig{
+        {Name: "sleeper", Kind: serviceCI, Command: []string{command}, Interval: 1, EnabledOn: []linkState{linkBATS}},
+    }})
+
+    //  let the command start
+    time.Sleep(1500 * time.Millisecond)
+}
+
+func TestQuitDrain(t *testing.T) {
+    startDrainTest("./sleep-short.sh")
+
+    w := httptest.NewRecorder()
+    quitHandle(w, httptest.NewRequest("GET", "/quit?mode=drain&deadline=10s", nil))
+    if !strings.HasPrefix(w.Body.String(), "zi-relay is draining") {
+        t.Fatalf("Unexpected drain response: %s", w.Body.String())
+    }
+
+    report := getStatus(t)
+    if report.Shutdown == nil || report.Shutdown.Mode != quitDrain || !report.Shutdown.CommandsRunning {
+        t.Errorf("Status should show the drain progress, got: %+v", report.Shutdown)
+    }
+
+    w = httptest.NewRecorder()
+    quitHandle(w, httptest.NewRequest("GET", "/quit?mode=immediate", nil))
+    if w.Code != 409 {
+        t.Errorf("A second quit during a drain should be refused, got %d", w.Code)
+    }
+    w = httptest.NewRecorder()
+    quitHandle(w, httptest.NewRequest("GET", "/quit?mode=refuse", nil))
+    if w.Code != 409 || len(quitChan) != 0 {
+        t.Errorf("A refusing quit during a drain should be refused as already shutting down, got %d", w.Code)
+    }
+
+    start := time.Now()
+    select {
+    case q := <-quitChan:
+        if !q || services.running() {
+            t.Error("Drain should quit once the command has finished")
+        } else {
+            t.Logf("Drain quit after %s", time.Since(start))
+        }
+    case <-time.After(8 * time.Second):
+        t.Error("Drain did not quit after the command finished")
+    }
+}
+
+func TestQuitDrainDeadline(t *testing.T) {
+    startDrainTest("./sleep-long.sh")
+
+    w := httptest.NewRecorder()
+    quitHandle(w, httptest.NewRequest("GET", "/quit?mode=drain&deadline=1s", nil))
+
+    select {
+    case q := <-quitChan:
+        if q && services.running() {
+            t.Log("Drain quit at the deadline with the command still running")
+        } else {
+            t.Error("Drain should have quit at the deadline")
+        }
+    case <-time.After(5 * time.Second):
+        t.Error("Drain did not quit at its deadline")
+    }
+}
+
+func TestDrainGivesUpOnCancel(t *testing.T) {
+    startDrainTest("./sleep-long.sh")
+    quitChan = make(chan bool)
+    ctx, cancel := context.WithCancel(context.Background())
+    done := make(chan bool)
+    go func() {
+        drain(ctx, time.Minute)
+        close(done)
+    }()
+
+    time.Sleep(100 * time.Millisecond)
+    cancel()
+    select {
+    case <-done:
+    case <-time.After(2 * time.Second):
+        t.Error("Drain should return once cancelled, not wait for the command or main")
+    }
+}
+
+func TestQuitAfterMainStopped(t *testing.T) {
+    quitChan = make(chan bool)
+    shutdown = &shutdownProgress{}
+    services = newServiceManager(context.Background())
+    done := make(chan struct{})
+    close(done)
+    quitDone = done
+    defer func() { quitDone = nil }()
+
+    w := httptest.NewRecorder()
+    returned := make(chan bool)
+    go func() {
+        quitHandle(w, httptest.NewRequest("GET", "/quit?mode=immediate", nil))
+        close(returned)
+    }()
+    select {
+    case <-returned:
+    case <-time.After(time.Second):
+        t.Error("Quit should not block once main has stopped reading quitChan")
+    }
+}
+
+func TestQuitBadMode(t *testing.T) {
+    w := httptest.NewRecorder()
+    quitHandle(w, httptest.NewRequest("GET", "/quit?mode=eventually", nil))
+    if w.Code != 400 {
+        t.Errorf("Unknown quit mode should be refused, got %d", w.Code)
+    }
+}
+
+func TestQuitOnSignal(t *testing.T) {
+    startDrainTest("./sleep-short.sh")
+    ctx, cancel := context.WithCancel(context.Background())
+    defer cancel()
+    sigs := notifyQuitSignals()
+    defer signal.Stop(sigs)
+    go quitOnSignal(ctx, sigs, quitDrain, 10 * time.Second)
+    time.Sleep(100 * time.Millisecond)
+
+    syscall.Kill(os.Getpid(), syscall.SIGTERM)
+    time.Sleep(100 * time.Millisecond)
+    if mode, _, _ := shutdown.report(); mode != quitDrain {
+        t.Fatalf("SIGTERM should have started a drain, mode is '%s'", mode)
+    }
+
+    //  a second signal doesn't wait for the drain
+    syscall.Kill(os.Getpid(), syscall.SIGINT)
+    select {
+    case q := <-quitChan:
+        if !q || !services.running() {
+            t.Error("Second signal should quit with the command still running")
+        }
+    case <-time.After(time.Second):
+        t.Fatal("Second signal did not quit")
+    }
+
+    //  let the drain finish so it doesn't quit the next test
+    select {
+    case <-quitChan:
+    case <-time.After(8 * time.Second):
+        t.Error("Drain did not finish after the command")
+    }
+}
+
+func TestSignalAfterQuitForces(t *testing.T) {
+    shutdown = &shutdownProgress{}
+    shutdown.begin(quitImmediate, time.Now())
+    quitChan = make(chan bool)
+    forced := make(chan os.Signal, 1)
+    defer func(old func(os.Signal)) { forceQuit = old }(forceQuit)
+    forceQuit = func(sig os.Signal) { forced <- sig }
+
+    //  main has stopped reading quitChan
+    ctx, cancel := context.WithCancel(context.Background())
+    cancel()
+    sigs := make(chan os.Signal, 1)
+    sigs <- syscall.SIGTERM
+    go quitOnSignal(ctx, sigs, quitImmediate, time.Minute)
+    go forceQuitOnSignal(sigs)
+
+    select {
+    case sig := <-forced:
+        if sig != syscall.SIGTERM {
+            t.Errorf("Expected SIGTERM to force the exit, got %s", sig)
+        }
+    case <-time.After(time.Second):
+        t.Error("A signal once main stopped quitting should force the exit")
+    }
+}
+
+func TestKillPendingGroups(t *testing.T) {
+    ctx, cancel := context.WithCancel(context.Background())
+    done := make(chan error)
+    go func() {
+        done <- runCommand(ctx, []string{"sh", "-c", "trap '' TERM; while true; do sleep 0.1; done"}, ioutil.Discard, time.Minute)
+    }()
+    time.Sleep(200 * time.Millisecond)
+    cancel()
+    time.Sleep(200 * time.Millisecond)
+
+    killPendingGroups()
+    select {
+    case err := <-done:
+        if err == nil {
+            t.Error("A killed command should fail")
+        }
+    case <-time.After(2 * time.Second):
+        t.Error("Expected the group killed without waiting for its grace")
+    }
+}
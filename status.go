@@ -0,0 +1,121 @@
+package main
+
+import (
+  "time"
+  json "encoding/json"
+  http "net/http"
+)
+
+/*
+**  statusReport - the /status response
+**    link        - the published link, the override if there is one
+**    source      - the source that reported link on the last poll
+**    sourcesSay  - the debounced link from the sources, when overridden
+**    zi          - what ZI last said, once a ZI source has answered
+*/
+type statusReport struct {
+    Link            linkState           `json:"link"`
+    Source          string              `json:"source,omitempty"`
+    SourcesSay      *linkState          `json:"sourcesSay,omitempty"`
+    Override        *linkOverride       `json:"override,omitempty"`
+    LastKnown       linkState           `json:"lastKnown"`
+    LastGood        time.Time           `json:"lastGood,omitzero"`
+    LastZIPoll      time.Time           `json:"lastZIPoll,omitzero"`
+    ZI              *ziReport           `json:"zi,omitempty"`
+    Pending         *pendingLink        `json:"pending,omitempty"`
+    Flaps           int                 `json:"suppressedFlaps"`
+    Readings        []sourceReading     `json:"sources"`
+    Disagreements   int                 `json:"sourceDisagreements"`
+    Shutdown        *shutdownReport     `json:"shutdown,omitempty"`
+    Services        []serviceStatus     `json:"services"`
+}
+
+//  pendingLink - a link seen but not yet published
+type pendingLink struct {
+    Link    linkState   `json:"link"`
+    Polls   int         `json:"polls"`
+}
+
+//  ziReport - the decoded details of the last ZI answer
+type ziReport struct {
+    Devices                     []ziConnection  `json:"devices"`
+    UsingBATS                   bool            `json:"usingBATS"`
+    ConnectionExplanation       string          `json:"connectionExplanation"`
+    UserOverride                bool            `json:"userOverride"`
+    SecondsUntilUserCanInteract int             `json:"secondsUntilUserCanInteract"`
+}
+
+//  shutdownReport - progress of a shutdown under way
+type shutdownReport struct {
+    Mode            string      `json:"mode"`
+    Started         time.Time   `json:"started"`
+    Deadline        time.Time   `json:"deadline,omitzero"`
+    CommandsRunning bool        `json:"commandsRunning"`
+}
+
+/*
+**  statusHandle - json report of the link, how it was decided and every
+**                 managed service
+*/
+func statusHandle(w http.ResponseWriter, r *http.Request) {
+    if r.Method != "GET" {
+        w.WriteHeader(405)
+        w.Write([]byte("Only accepts GET"))
+        return
+    }
+
+    link := monitor.report()
+    report := statusReport{
+        Link:           link.Published.State,
+        Source:         link.Source,
+        LastKnown:      link.Published.Known,
+        LastGood:       link.Published.LastGood,
+        LastZIPoll:     link.LastZIPoll,
+        Flaps:          link.Flaps,
+        Readings:       link.Readings,
+        Disagreements:  link.Disagreements,
+        Services:       []serviceStatus{},
+    }
+    if link.Override != nil {
+        report.Link = link.Override.State
+        report.Source = "override"
+        report.SourcesSay = &link.Published.State
+        report.Override = link.Override
+    }
+    if !link.LastZIPoll.IsZero() {
+        zi := link.Published.ZI
+        report.ZI = &ziReport{
+            Devices:                        zi.ConnObjectList,
+            UsingBATS:                      zi.UsingBats,
+            ConnectionExplanation:          zi.ConnectionExplanation,
+            UserOverride:                   zi.UserOverride,
+            SecondsUntilUserCanInteract:    zi.SecondsUntilUserCanInteract,
+        }
+        if report.ZI.Devices == nil {
+            report.ZI.Devices = []ziConnection{}
+        }
+    }
+    if link.Pending > 0 {
+        report.Pending = &pendingLink{Link: link.Candidate, Polls: link.Pending}
+    }
+    if report.Readings == nil {
+        report.Readings = []sourceReading{}
+    }
+    if services != nil {
+        report.Services = services.statuses()
+    }
+
+    mode, started, deadline := shutdown.report()
+    if mode != "" {
+        report.Shutdown = &shutdownReport{Mode: mode, Started: started}
+        if mode == quitDrain {
+            report.Shutdown.Deadline = deadline
+            report.Shutdown.CommandsRunning = services.running()
+        }
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    encoder := json.NewEncoder(w)
+    encoder.SetIndent("", "  ")
+    encoder.Encode(report)
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+    "testing"
+    "context"
+    "time"
+    json "encoding/json"
+    httptest "net/http/httptest"
+)
+
+func getStatus(t *testing.T) statusReport {
+    w := httptest.NewRecorder()
+    statusHandle(w, httptest.NewRequest("GET", "/status", nil))
+    var report statusReport
+    if err := json.Unmarshal(w.Body.Bytes(), &report); err != nil {
+        t.Fatalf("Could not decode status %s: %s", w.Body.String(), err)
+    }
+    return report
+}
+
+func TestStatusServices(t *testing.T) {
+    shutdown = &shutdownProgress{}
+    ctx, cancel := context.WithCancel(context.Background())
+    defer cancel()
+    services = newServiceManager(ctx)
+    monitor = newLinkMonitor(nil, monitorConfig{Interval: 5}, services)
+    services.publish(linkStatus{State: linkBATS})
+    services.apply(&relayConfig{Services: []serviceConfig{
+        {Name: "fails", Kind: serviceCI, Command: []string{"sh", "-c", "exit 3"}, Interval: 60, EnabledOn: []linkState{linkBATS}},
+        {Name: "sleeper", Kind: serviceCI, Command: []string{"./sleep-short.sh"}, Interval: 60, EnabledOn: []linkState{linkBATS}},
+        {Name: "vsat-only", Kind: serviceCI, Command: []string{"true"}, Interval: 60, EnabledOn: []linkState{linkVSAT}},
+    }})
+    defer services.stopAll()
+    time.Sleep(1500 * time.Millisecond)
+
+    report := getStatus(t)
+    if len(report.Services) != 3 {
+        t.Fatalf("Expected three services, got %+v", report.Services)
+    }
+    fails, sleeper, vsatOnly := report.Services[0], report.Services[1], report.Services[2]
+    if fails.Name != "fails" || !fails.Enabled || fails.Running || fails.LastExit == nil || *fails.LastExit != 3 || fails.LastError == "" || fails.NextRun.IsZero() {
+        t.Errorf("Unexpected status for the failed run: %+v", fails)
+    }
+    if !sleeper.Running || sleeper.Started.IsZero() || !sleeper.NextRun.IsZero() {
+        t.Errorf("Unexpected status for the running command: %+v", sleeper)
+    }
+    if vsatOnly.Enabled || !vsatOnly.Started.IsZero() {
+        t.Errorf("vsat-only should be disabled and never have run, got %+v", vsatOnly)
+    }
+}
+
+func TestStatusZI(t *testing.T) {
+    shutdown = &shutdownProgress{}
+    services = nil
+    monitor = newLinkMonitor(nil, monitorConfig{Interval: 5}, nil)
+    if report := getStatus(t); report.ZI != nil {
+        t.Errorf("Expected no zi details before ZI answered, got %+v", report.ZI)
+    }
+
+    monitor.published = linkStatus{State: linkLTE, ZI: ziStatus{
+        ConnObjectList:              []ziConnection{{DeviceType: "lte", DeviceName: "lte0", Connected: true}},
+        SecondsUntilUserCanInteract: 30,
+        ConnectionExplanation:       "LTE in range",
+        UserOverride:                true,
+    }}
+    monitor.lastZIPoll = time.Now()
+    zi := getStatus(t).ZI
+    if zi == nil || len(zi.Devices) != 1 || zi.Devices[0].DeviceName != "lte0" || !zi.Devices[0].Connected ||
+        zi.UsingBATS || zi.ConnectionExplanation != "LTE in range" || !zi.UserOverride || zi.SecondsUntilUserCanInteract != 30 {
+        t.Errorf("Unexpected zi details: %+v", zi)
+    }
+}
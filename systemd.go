@@ -0,0 +1,138 @@
+package main
+
+import (
+  "os"
+  "log/slog"
+  "net"
+  "time"
+  "strconv"
+  "strings"
+  "context"
+)
+
+/*
+**  notifySystemd - sends state, newline separated VAR=value lines, to the
+**                  sd_notify socket in $NOTIFY_SOCKET.  does nothing when
+**                  not run by systemd.  an '@' socket is abstract
+*/
+func notifySystemd(state string) error {
+    socket := os.Getenv("NOTIFY_SOCKET")
+    if socket == "" {
+        return nil
+    }
+
+    conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+    if err != nil {
+        return err
+    }
+    defer conn.Close()
+    _, err = conn.Write([]byte(state))
+    return err
+}
+
+/*
+**  watchdogInterval - how often systemd wants WATCHDOG=1, half of
+**                     $WATCHDOG_USEC.  zero if the watchdog is off or
+**                     meant for another process
+*/
+func watchdogInterval() time.Duration {
+    usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+    if err != nil || usec <= 0 {
+        return 0
+    }
+    if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+        return 0
+    }
+    return time.Duration(usec) * time.Microsecond / 2
+}
+
+/*
+**  systemdStatus - one line summary of the link and running commands
+*/
+func systemdStatus(m *linkMonitor, feeds *serviceManager) string {
+    report := m.report()
+    status := "link " + report.Published.State.String()
+    if report.Override != nil {
+        status = "link " + report.Override.State.String() + " (override)"
+    }
+
+    if running := feeds.runningNames(); len(running) > 0 {
+        status += ", running " + strings.Join(running, " ")
+    } else {
+        status += ", no commands running"
+    }
+
+    if mode, _, _ := shutdown.report(); mode != "" {
+        status = "shutting down (" + mode + "), " + status
+    }
+    return status
+}
+
+/*
+**  superviseSystemd - tells systemd we are ready once m has polled, then
+**                     keeps STATUS= current and pings the watchdog while m
+**                     is healthy, until ctx is cancelled.  the status
+**                     server must already be listening
+*/
+func superviseSystemd(ctx context.Context, m *linkMonitor, feeds *serviceManager) {
+    if os.Getenv("NOTIFY_SOCKET") == "" {
+        return
+    }
+
+    select {
+    case <-m.firstPoll():
+    case <-ctx.Done():
+        return
+    }
+    status := systemdStatus(m, feeds)
+    err := notifySystemd("READY=1\nSTATUS=" + status)
+    if err != nil {
+        slog.Warn("Could not notify systemd", "error", err)
+    }
+
+    watchdog := watchdogInterval()
+    tick := watchdog
+    if tick == 0 || tick > 5 * time.Second {
+        tick = 5 * time.Second
+    }
+    ticker := time.NewTicker(tick)
+    defer ticker.Stop()
+    lastPing := time.Now()
+    wasHealthy := true
+
+    for {
+        select {
+        case <-ticker.C:
+        case <-ctx.Done():
+            return
+        }
+
+        now := time.Now()
+        state := ""
+        if current := systemdStatus(m, feeds); current != status {
+            status = current
+            state = "STATUS=" + status + "\n"
+        }
+
+        healthy := m.healthy(now)
+        if healthy != wasHealthy {
+            if healthy {
+                slog.Info("Link monitor is polling again, resuming watchdog pings")
+            } else {
+                slog.Warn("Link monitor has stopped polling, withholding watchdog pings")
+            }
+            wasHealthy = healthy
+        }
+        if watchdog > 0 && healthy && now.Sub(lastPing) >= watchdog - tick / 2 {
+            state += "WATCHDOG=1\n"
+            lastPing = now
+        }
+
+        if state != "" {
+            err = notifySystemd(strings.TrimSuffix(state, "\n"))
+            if err != nil {
+                slog.Warn("Could not notify systemd", "error", err)
+            }
+        }
+    }
+}
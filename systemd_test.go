@@ -0,0 +1,86 @@
+package main
+
+import (
+    ioutil "io/ioutil"
+    "testing"
+    "strings"
+    "context"
+    "time"
+    "net"
+    "os"
+    filepath "path/filepath"
+)
+
+func TestSuperviseSystemd(t *testing.T) {
+    dir, err := ioutil.TempDir("", "zi-relay-notify")
+    if err != nil {
+        t.Fatalf("could not create socket dir: %s", err)
+    }
+    defer os.RemoveAll(dir)
+    socket := filepath.Join(dir, "notify")
+    conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: socket, Net: "unixgram"})
+    if err != nil {
+        t.Fatalf("could not listen on %s: %s", socket, err)
+    }
+    defer conn.Close()
+    t.Setenv("NOTIFY_SOCKET", socket)
+    t.Setenv("WATCHDOG_USEC", "200000")
+    shutdown = &shutdownProgress{}
+
+    ctx, cancel := context.WithCancel(context.Background())
+    defer cancel()
+    feeds := newServiceManager(ctx)
+    bats, _ := newLinkSource(sourceConfig{Type: sourceCommand, Command: []string{"echo", "bats"}}, "")
+    m := newLinkMonitor([]LinkSource{bats}, monitorConfig{Interval: 5}, feeds)
+    go superviseSystemd(ctx, m, feeds)
+    go m.run(ctx)
+
+    messages := make(chan string, 10)
+    go func() {
+        buf := make([]byte, 4096)
+        for {
+            n, err := conn.Read(buf)
+            if err != nil {
+                return
+            }
+            messages <- string(buf[:n])
+        }
+    }()
+    next := func() string {
+        select {
+        case message := <-messages:
+            return message
+        case <-time.After(2 * time.Second):
+            return ""
+        }
+    }
+
+    if ready := next(); ready != "READY=1\nSTATUS=link bats, no commands running" {
+        t.Fatalf("Expected readiness after the first poll, got %q", ready)
+    }
+    if ping := next(); ping != "WATCHDOG=1" {
+        t.Errorf("Expected a watchdog ping, got %q", ping)
+    }
+
+    //  watchdog pings carry on meanwhile
+    shutdown.begin(quitImmediate, time.Now())
+    stopping := next()
+    for stopping == "WATCHDOG=1" {
+        stopping = next()
+    }
+    if !strings.HasPrefix(stopping, "STOPPING=1\n") {
+        t.Errorf("Expected STOPPING=1 once shutdown began, got %q", stopping)
+    }
+}
+
+func TestWatchdogInterval(t *testing.T) {
+    t.Setenv("WATCHDOG_USEC", "30000000")
+    t.Setenv("WATCHDOG_PID", "")
+    if interval := watchdogInterval(); interval != 15 * time.Second {
+        t.Errorf("Expected pings every 15s, got %s", interval)
+    }
+    t.Setenv("WATCHDOG_PID", "1")
+    if interval := watchdogInterval(); interval != 0 {
+        t.Errorf("A watchdog for another pid should be ignored, got %s", interval)
+    }
+}
@@ -3,254 +3,449 @@ package main
 import (
   "os"
   "flag"
-  "log"
+  "log/slog"
   "time"
   "fmt"
-  "bytes"
+  "io"
+  "errors"
+  "strings"
+  "syscall"
   "strconv"
-  json "encoding/json"
+  "net"
+  "context"
+  "sync"
   http "net/http"
   exec "os/exec"
+  signal "os/signal"
 )
 
 var (
     uri          = flag.String("uri", "http://zeroimpact.mtnsatcloud.com:8084/v1.0/connectionStatus/", "ZeroImpact URI")
-    pidfile      = flag.String("pidfile", "", "optional, write pid of self to here")
+    pidfile      = flag.String("pidfile", "", "optional, lock and write pid of self to here")
     healthport   = flag.Int("healthport", 7003, "port to listen for ping/quit requests on")
     shipcode     = flag.String("shipcode", "UNKNOWN", "shipcode to use as lookup into chef-server for jenkins promote job")
-    verbose      = flag.Bool("verbose", false, "increase logging output")
+    verbose      = flag.Bool("verbose", false, "log at debug level, same as -log-level debug")
+    logFormat    = flag.String("log-format", logLogfmt, "log output format: json or logfmt")
+    logLevel     = flag.String("log-level", "info", "lowest level logged: debug, info, warn or error")
+    configFile   = flag.String("config", "", "optional, JSON file declaring the managed services")
+    quitMode     = flag.String("quitmode", quitRefuse, "how /quit behaves without a mode: immediate, refuse or drain")
+    signalMode   = flag.String("signalmode", quitDrain, "how SIGTERM, SIGINT and SIGQUIT quit: immediate or drain")
+    drainTimeout = flag.Duration("draintimeout", 30 * time.Minute, "longest a drain waits for running commands before quitting")
 )
 
 var (
-    rabbitProg  = "/etc/init.d/rabbitmq-stopable-shovel"
-    chefClient  = "chef-client"
     quitChan    chan bool
-    stopZIMon   chan bool
-    cmdStatusReq    map[string] chan bool
-    cmdStatusResp   map[string] chan bool
+    quitDone    <-chan struct{}  //  closed once main stops reading quitChan
+    services    *serviceManager
+    monitor     *linkMonitor
 )
 
-type zeroimpactResponse struct {
-    UsingBats bool `json:"usingBats"`
+/*
+**  listenStatus - opens the -healthport listener for statusServer
+*/
+func listenStatus() (net.Listener, error) {
+    return net.Listen("tcp", ":" + strconv.Itoa(*healthport))
 }
 
 /*
-**  serve status/health requests
+**  serve status/health requests on listener until ctx is cancelled
 *   kill application when told to
 */
-func statusServer() {
+func statusServer(ctx context.Context, listener net.Listener) {
     http.HandleFunc("/ping", pingHandle)
     http.HandleFunc("/quit", quitHandle)
+    http.HandleFunc("/reload", reloadHandle)
+    http.HandleFunc("/status", statusHandle)
+    http.HandleFunc("/override", overrideHandle)
+    http.HandleFunc("/metrics", metricsHandle)
+    http.HandleFunc("/services/", servicesHandle)
 
     //  create server that doesn't leave things open forever
     s := &http.Server{
-            Addr:           ":7003",
             ReadTimeout:    10 * time.Second,
             WriteTimeout:   10 * time.Second,
         }
-    s.ListenAndServe()
+    go func(){
+        <-ctx.Done()
+        s.Shutdown(context.Background())
+    }()
+    s.Serve(listener)
 }
 
 func pingHandle(w http.ResponseWriter, r *http.Request){
     fmt.Fprintf(w, "PONG\n")
 }
 
+/*
+**  overrideHandle - operator override of the link state
+**    GET    - show the override
+**    POST   - set one, link=<state> and for=<duration> or until=<RFC3339 time>
+**    DELETE - clear it
+*/
+func overrideHandle(w http.ResponseWriter, r *http.Request) {
+    switch r.Method {
+    case "GET":
+        override := monitor.report().Override
+        if override == nil {
+            fmt.Fprintf(w, "no override\n")
+        } else {
+            fmt.Fprintf(w, "override: %s until %s, set %s\n", override.State, override.Expires.Format(time.RFC3339), override.Set.Format(time.RFC3339))
+        }
+    case "POST":
+        state, err := parseLinkState(r.FormValue("link"))
+        if err != nil {
+            w.WriteHeader(400)
+            fmt.Fprintf(w, "%s\n", err)
+            return
+        }
+
+        var expires time.Time
+        if until := r.FormValue("until"); until != "" {
+            expires, err = time.Parse(time.RFC3339, until)
+        } else if duration, perr := time.ParseDuration(r.FormValue("for")); perr == nil {
+            expires = time.Now().Add(duration)
+        } else {
+            err = errors.New("an override needs for=<duration> or until=<RFC3339 time>")
+        }
+        if err != nil {
+            w.WriteHeader(400)
+            fmt.Fprintf(w, "%s\n", err)
+        } else if !expires.After(time.Now()) {
+            w.WriteHeader(400)
+            fmt.Fprintf(w, "override would already have expired\n")
+        } else {
+            monitor.setOverride(state, expires)
+            fmt.Fprintf(w, "override: %s until %s\n", state, expires.Format(time.RFC3339))
+        }
+    case "DELETE":
+        monitor.clearOverride()
+        fmt.Fprintf(w, "override cleared\n")
+    default:
+        w.WriteHeader(405)
+        fmt.Fprintf(w, "Only accepts GET, POST and DELETE")
+    }
+}
+
+/*
+**  quitHandle - shuts zi-relay down
+**    mode=immediate - quit now
+**    mode=refuse    - quit only if no external commands are running
+**    mode=drain     - stop launching commands, quit when the running ones
+**                     finish or deadline=<duration> passes
+**  mode defaults to -quitmode and deadline to -draintimeout
+*/
 func quitHandle(w http.ResponseWriter, r *http.Request) {
-    //  check if a chef-client run is on-going
-    canStop := false
-    for name, sChan := range cmdStatusReq {
-        sChan <- true
-        cStatus := <-cmdStatusResp[name]
-        canStop = canStop || cStatus
+    mode := r.FormValue("mode")
+    if mode == "" {
+        mode = *quitMode
+    }
+    timeout := *drainTimeout
+    if d := r.FormValue("deadline"); d != "" {
+        var err error
+        timeout, err = time.ParseDuration(d)
+        if err != nil {
+            w.WriteHeader(400)
+            fmt.Fprintf(w, "bad deadline: %s\n", err)
+            return
+        }
+    }
+    if !validQuitMode(mode) {
+        w.WriteHeader(400)
+        fmt.Fprintf(w, "unknown quit mode %s, use immediate, refuse or drain\n", mode)
+        return
+    }
+
+    if current, _, _ := shutdown.report(); current != "" {
+        w.WriteHeader(409)
+        fmt.Fprintf(w, "zi-relay is already shutting down, mode %s\n", current)
+        return
     }
-    if canStop {
+    //  check if a chef-client run is on-going
+    if mode == quitRefuse && services.running() {
         fmt.Fprintf(w, "one or more external commands are running.  Please wait a few minutes and try again")
-        quitChan <- false
+        sendQuit(false)
+        return
+    }
+
+    err := shutdown.begin(mode, time.Now().Add(timeout))
+    if err != nil {
+        w.WriteHeader(409)
+        fmt.Fprintf(w, "%s\n", err)
+    } else if mode == quitDrain {
+        fmt.Fprintf(w, "zi-relay is draining, it will shut down once running commands finish or in %s\n", timeout)
+        startDrain(timeout)
     } else {
         fmt.Fprintf(w, "zi-relay is now shutting down\n")
-        stopZIMon <- false
-        quitChan <- true
+        sendQuit(true)
+    }
+}
+
+/*
+**  sendQuit - hands quit to main, dropping it once main has stopped
+**             reading quitChan
+*/
+func sendQuit(quit bool) {
+    select {
+    case quitChan <- quit:
+    case <-quitDone:
+    }
+}
+
+func reloadHandle(w http.ResponseWriter, r *http.Request) {
+    if r.Method != "POST" {
+        w.WriteHeader(405)
+        fmt.Fprintf(w, "Only accepts POST")
+    } else {
+        err := reloadConfig()
+        if errors.Is(err, errShuttingDown) {
+            w.WriteHeader(503)
+            fmt.Fprintf(w, "Config not reloaded: %s\n", err)
+        } else if err != nil {
+            w.WriteHeader(400)
+            fmt.Fprintf(w, "Config not reloaded, still running the old one: %s\n", err)
+        } else {
+            fmt.Fprintf(w, "Config reloaded\n")
+        }
+    }
+}
+
+/*
+**  reloadConfig - reads the -config file again and applies it to the
+**                 running services.  an invalid file leaves them untouched,
+**                 and nothing is reloaded once a shutdown has begun
+*/
+func reloadConfig() error {
+    if mode, _, _ := shutdown.report(); mode != "" {
+        slog.Warn("Not reloading config while shutting down", "config", *configFile, "mode", mode)
+        return errShuttingDown
+    }
+    cfg, err := loadConfig(*configFile)
+    if err != nil {
+        slog.Error("Failed to reload config", "config", *configFile, "error", err)
+        return err
+    }
+    sources, err := buildSources(cfg.Monitor, *uri)
+    if err != nil {
+        slog.Error("Failed to reload config", "config", *configFile, "error", err)
+        return err
     }
+    slog.Info("Reloading config", "config", *configFile)
+    monitor.configure(sources, cfg.Monitor)
+    services.apply(cfg)
+    return nil
 }
 
 /*
-**  check_pidfile - if pidfile flag is set, write pid to it
+**  reloadOnHangup - reloads the config every time a SIGHUP comes in, until
+**                   ctx is cancelled
+*/
+func reloadOnHangup(ctx context.Context) {
+    hup := make(chan os.Signal, 1)
+    signal.Notify(hup, syscall.SIGHUP)
+    defer signal.Stop(hup)
+    for {
+        select {
+        case <-hup:
+            reloadConfig()
+        case <-ctx.Done():
+            return
+        }
+    }
+}
+
+/*
+**  check_pidfile - if pidfile flag is set, lock it and write pid to it for
+**                  the life of the process.  refuses to start if another
+**                  zi-relay holds it
 */
 func check_pidfile(){
     if *pidfile != "" {
-        pid := []byte(strconv.Itoa(os.Getpid()))
-        pfile, err := os.Create(*pidfile)
+        pfile, err := lockPidfile(*pidfile)
         if err != nil {
-            log.Println("Could not open pidfile: " + *pidfile + ".  Carrying on")
-        } else {
-            pfile.Write(pid)
-            pfile.Close()
+            fatal("Could not take pidfile", "pidfile", *pidfile, "error", err)
         }
+        pidLock.Lock()
+        pidHeld = pfile
+        pidLock.Unlock()
     }
 }
 
 /*
-**  remove_pidfile - if pidfile flag is set, remove when shutting down
+**  remove_pidfile - if the pidfile is held, remove and unlock it.  safe to
+**                   call more than once
 */
 func remove_pidfile(){
-    if *pidfile != "" {
+    pidLock.Lock()
+    defer pidLock.Unlock()
+    if pidHeld != nil {
         err := os.Remove(*pidfile)
         if err != nil {
-            log.Println("Could not remove pidfile:  " + *pidfile + ". With error: " + err.Error())
+            slog.Warn("Could not remove pidfile", "pidfile", *pidfile, "error", err)
         }
+        pidHeld.Close()
+        pidHeld = nil
     }
 }
 
 
 
 /*
-**  zeroImpactMonitor - polls the zero impact status interface and notifies
-**                      all chans in feed map of current status
-**
+**  shovelManagement - turns the service's shovels on or off to match the
+**                     link, reading their actual state through the
+**                     service's shovel backend
 */
-func zeroImpactMonitor(uri *string, feeds map[string] chan bool, verbose bool) {
-    //  poll the zi status interface until told to stop
-    monitor := true
-    go func(){
-        for {
-            monitor = <-stopZIMon
-        }
-    }()
+func shovelManagement(svc serviceConfig, ms *managedService) {
+    defer removePidfileOnPanic()
+    defer close(ms.done)
 
-    for monitor {
-        resp, err := http.Get(*uri)
-        if err != nil {
-            log.Printf("Failed to access ZeroImpact service at %s with error %s\n", *uri, err)
-        } else {
-            var ziStatus zeroimpactResponse
-            decoder := json.NewDecoder(resp.Body)
-            err = decoder.Decode(&ziStatus)
-            resp.Body.Close()
-            if err != nil {
-                log.Printf("failed to decode zi response, %s\n", err)
-            } else {
-                for _, feed := range feeds {
-                    feed <- ziStatus.UsingBats
-                }
-            }
-        }
-        time.Sleep(5 * time.Second)
+    if !ms.waitForPrevious() {
+        return
     }
-}
-
-//  turn stopable shovel on or off
-func shovelManagement(feed, statusReq, statusResp chan bool, sleepSeconds int, verbose bool) {
-    //  asynchronously report is chef running status
-    shovelRunningStatus := false
-    go func(){
-        for {
-            <-statusReq
-            statusResp <- shovelRunningStatus
-        }
-    }()
 
-    //  asynchronously set boolean for which rabbit command to run
-    feedStatus := false
-    go func(){
-        for {
-            feedStatus = <-feed
+    shovels := newShovelSet(svc)
+    ms.state.update(func(s *serviceStatus) { s.Shovels = shovels.statuses() })
+    for ms.waitIfFailed() {
+        feedStatus := ms.state.currentLink()
+        logger := slog.With("service", svc.Name, "link", feedStatus.describe())
+        ctx, cancel := ms.runContext()
+        shovels.measure(ctx, time.Now(), logger)
+        cancel()
+        if shovels.pending(feedStatus, time.Now()) {
+            run := ms.begin()
+            runLogger := logger.With("run", run.ID)
+            ctx, cancel := ms.runContext()
+            err := timedOut(ctx, shovels.reconcile(ctx, feedStatus, run.output, runLogger))
+            cancel()
+            if err != nil {
+                handle_cmd_error(runLogger, err)
+            }
+            ms.finish(run, err)
         }
-    }()
+        ms.state.update(func(s *serviceStatus) { s.Shovels = shovels.statuses() })
 
-    //  verified that stopping a stoped shovel or starting a started shovel doesn't
-    //  effect the rabbit broker.  the rabbit broker informs the caller that the 
-    //  current state matches desires state and to go away.  it says 'err' but that's
-    //  a gentle way of saying, 'YES!  AND I AM ALREADY!'
-    for {
-        shovelRunningStatus = true
-        command := "stop"
-        if feedStatus {
-            command = "start"
-        }
-        if verbose {
-            log.Println(rabbitProg + " " + command)
+        if !ms.wait(&svc.Interval) {
+            return
         }
-        cmd := exec.Command(rabbitProg, command)
-        var out bytes.Buffer
-        cmd.Stdout = &out
-        cmd.Stderr = &out
-        err := cmd.Run()
-        if err != nil {
-            handle_cmd_error(err, out)
-        }
-        shovelRunningStatus = false
-
-        time.Sleep(time.Duration(sleepSeconds) * time.Second)
     }
 }
 
 /*  
 **  ciManagement - handles execution of ci pieces and coordination
 **                       with other functions
-**  listens on the feed channel in a go routine which sets the feedStatus
-**  which lets the ci job start
-**    if the ci job is running, ignore whatever comes in on feed
-**  starts a go routine that shares state (ciStatus) with this.  it
-**  will return ciStatus on status whenever it is called
+**  reads the latest link status from the service state before each run
+**  and records the run there for the status server
 **  takes a function which handles the interop with the ci command to run
-**  and any error handling.  
+**  and any error handling.  it should give up when ctx is cancelled and
+**  write anything worth keeping from the run to output
 **    returns an error
 */
-type ciAction func(verbose bool) (err error)
-func ciManagement(name string, feed, statusReq, statusResp chan bool, action ciAction, sleepSeconds int, verbose bool){
-    //  asynchronously report is chef running status
-    chefStatus := false
-    go func(){
-        for {
-            <-statusReq
-            statusResp <- chefStatus
+type ciAction func(ctx context.Context, output io.Writer) (err error)
+
+//  how long a killed command's children get to let go of its output
+var commandWaitDelay = 5 * time.Second
+func ciManagement(svc serviceConfig, ms *managedService, action ciAction){
+    defer removePidfileOnPanic()
+    defer close(ms.done)
+
+    if !ms.waitForPrevious() {
+        return
+    }
+
+    for ms.waitIfFailed() {
+        feedStatus := ms.state.currentLink()
+        if svc.decide(feedStatus) {
+            slog.Debug("Enabled, begin the job", "service", svc.Name, "link", feedStatus.describe())
+            run := ms.begin()
+            ctx, cancel := ms.runContext()
+            err := timedOut(ctx, action(ctx, run.output))
+            cancel()
+            ms.finish(run, err)
+        } else {
+            slog.Debug("Disabled, do nothing", "service", svc.Name, "link", feedStatus.describe())
         }
-    }()
 
-    //  asynchronously set boolean for 'should start another chef client run'
-    feedStatus := false
-    go func(){
-        for {
-            feedStatus = <-feed
+        if !ms.wait(&svc.Interval) {
+            return
         }
-    }()
+    }
+}
 
-    for {
-        if feedStatus {
-            if verbose {
-                log.Println(name + ": ZI is on, begin the job")
-            }
-            chefStatus = true
-            err := action(verbose)
-            if err != nil {
-                log.Println(name + " action failed")
+/*
+**  runCommand - runs argv in its own process group, output going to output.
+**               when ctx is done the whole group gets SIGTERM, then SIGKILL
+**               grace later
+*/
+func runCommand(ctx context.Context, argv []string, output io.Writer, grace time.Duration) error {
+    cmd := newCommand(ctx, argv, grace)
+    cmd.Stdout = output
+    cmd.Stderr = output
+    return cmd.Run()
+}
+
+/*
+**  newCommand - argv set up to run in its own process group and be killed
+**               the way runCommand describes.  the SIGKILL still goes out
+**               after the command itself has exited, to whatever is left
+**               of its group.  the group id isn't reused while any of it
+**               is alive
+*/
+func newCommand(ctx context.Context, argv []string, grace time.Duration) *exec.Cmd {
+    cmd := exec.CommandContext(ctx, argv[0], argv[1:]...)
+    cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+    cmd.Cancel = func() error {
+        group := -cmd.Process.Pid
+        pendingKills.Lock()
+        var kill *time.Timer
+        kill = time.AfterFunc(grace, func() {
+            syscall.Kill(group, syscall.SIGKILL)
+            pendingKills.Lock()
+            if pendingKills.groups[group] == kill {
+                delete(pendingKills.groups, group)
             }
-            chefStatus = false
-        } else if !feedStatus && verbose {
-            log.Println(name + ": ZI is off.  Do nothing")
-        }
+            pendingKills.Unlock()
+        })
+        pendingKills.groups[group] = kill
+        pendingKills.Unlock()
+        return syscall.Kill(group, syscall.SIGTERM)
+    }
+    cmd.WaitDelay = grace + commandWaitDelay
+    return cmd
+}
+
+//  pendingKills - process groups sent SIGTERM and still due a SIGKILL
+var pendingKills = struct {
+    sync.Mutex
+    groups  map[int] *time.Timer
+}{groups: make(map[int] *time.Timer)}
 
-        time.Sleep(time.Duration(sleepSeconds) * time.Second)
+/*
+**  killPendingGroups - SIGKILLs every group still due one now, rather than
+**                      when its grace runs out
+*/
+func killPendingGroups() {
+    pendingKills.Lock()
+    defer pendingKills.Unlock()
+    for group, kill := range pendingKills.groups {
+        if kill.Stop() {
+            syscall.Kill(group, syscall.SIGKILL)
+        }
+        delete(pendingKills.groups, group)
     }
 }
 
 /*
-**  chefClientAction - wrapper function that holds the chef client ci action
+**  commandAction - builds the ci action that runs a configured command,
+**                  killing it grace after SIGTERM when cancelled
 **
 */
-func chefClientAction(verbose bool) (err error) {
-    cmd := exec.Command(chefClient)
-    var out bytes.Buffer
-    cmd.Stdout = &out
-    cmd.Stderr = &out
-    err = cmd.Run()
-    if verbose {
-        log.Println("Finished a chef-client run")
-    }
-    if err != nil {
-        handle_cmd_error(err, out)
+func commandAction(name string, argv []string, grace time.Duration) ciAction {
+    return func(ctx context.Context, output io.Writer) (err error) {
+        err = runCommand(ctx, argv, output, grace)
+        if err != nil {
+            handle_cmd_error(slog.With("service", name, "command", strings.Join(argv, " ")), err)
+        }
+        return err
     }
-    return err
 }
 
 /*
@@ -259,75 +454,154 @@ func chefClientAction(verbose bool) (err error) {
 **
 **  all of the REST calls will be in the the promote-to-ship wrapper lib
 */
-func fetchCIArtifacts(verbose bool) (err error) {
+func fetchCIArtifacts(ctx context.Context, output io.Writer) (err error) {
     promote := &PromoteToShip{Shipcode: *shipcode}
-    err = promote.Start()
+    defer func() {
+        result := promote.Result
+        if result == "" {
+            result = "error"
+        }
+        metrics.promoted(result)
+    }()
+    fmt.Fprintf(output, "starting promote-to-ship for %s\n", *shipcode)
+    err = promote.StartContext(ctx)
     if err != nil {
-        log.Printf("Failed to start promotion job with error: %s\n", err)
+        fmt.Fprintf(output, "failed to start: %s\n", err)
+        slog.Error("Failed to start promotion job", "shipcode", *shipcode, "error", err)
         return err
     }
-    err = promote.Wait(1)
+    err = promote.WaitContext(ctx, 1)
+    fmt.Fprintf(output, "job result: %s\n", promote.Result)
     if err != nil {
-        log.Printf("Failed to wait for promotion job with error: %s\n", err)
+        fmt.Fprintf(output, "failed: %s\n", err)
+        slog.Error("Failed to wait for promotion job", "shipcode", *shipcode, "result", promote.Result, "error", err)
     }
     return err
 }
 
+/*
+**  startService - launch the management go routine matching the kind
+**                 of service
+*/
+func startService(svc serviceConfig, ms *managedService) {
+    switch svc.Kind {
+    case serviceToggle:
+        go shovelManagement(svc, ms)
+    case serviceCI:
+        action := ciActions[svc.Action]
+        if svc.Action == "" {
+            action = commandAction(svc.Name, svc.Command, svc.killGrace())
+        }
+        go ciManagement(svc, ms, action)
+    }
+}
+
 /*
 **  handle_cmd_error - function to handle errors in command line executions
-**                   only prints stdout and stderr to stdout for now, will 
-**                   do more later
+**                   logs the error and exit code with the service's
+**                   fields.  the output is kept in the run history
 **
 */
-func handle_cmd_error(err error, out bytes.Buffer) {
-    log.Printf(chefClient + " command failed with: %s", err)
-    log.Printf("outputs were: %s", out)
+func handle_cmd_error(logger *slog.Logger, err error) {
+    args := []any{"error", err}
+    if code := exitCode(err); code != nil {
+        args = append(args, "exit_code", *code)
+    }
+    logger.Error("Command failed", args...)
 }
 
 /*
 **  main - handles creation of main go routines
 **       - flag parsing
+**       - config loading
 **       - server creation
 **       - pidfile handling
 **       - zi checker
 */
 func main(){
     flag.Parse()
+    if err := setupLogging(*logFormat, *logLevel, *verbose); err != nil {
+        fatal("Bad logging flags", "error", err)
+    }
+    if !validQuitMode(*quitMode) {
+        fatal("unknown -quitmode " + *quitMode)
+    }
+    if !validSignalMode(*signalMode) {
+        fatal("unknown -signalmode " + *signalMode)
+    }
+    cfg, err := loadConfig(*configFile)
+    if err != nil {
+        fatal("Could not load config", "config", *configFile, "error", err)
+    }
+    sources, err := buildSources(cfg.Monitor, *uri)
+    if err != nil {
+        fatal("Could not build link sources", "error", err)
+    }
     check_pidfile()
     defer remove_pidfile()
 
-    ziStatusFeeds := make(map[string] chan bool, 3)
-    ziStatusFeeds["shovel"] = make(chan bool, 10)
-    ziStatusFeeds["chef"] = make(chan bool, 10)
-    ziStatusFeeds["promote"] = make(chan bool, 10)
-    cmdStatusReq = make(map[string] chan bool, 3)
-    cmdStatusReq["shovel"] = make(chan bool)
-    cmdStatusReq["chef"] = make(chan bool)
-    cmdStatusReq["promote"] = make(chan bool)
-    cmdStatusResp = make(map[string] chan bool, 3)
-    cmdStatusResp["shovel"] = make(chan bool)
-    cmdStatusResp["chef"] = make(chan bool)
-    cmdStatusResp["promote"] = make(chan bool)
-    go zeroImpactMonitor(uri, ziStatusFeeds, *verbose)
-
-    //  manage the stopable shovel
-    go shovelManagement(ziStatusFeeds["shovel"], cmdStatusReq["shovel"], cmdStatusResp["shovel"], 5, *verbose)
-
-    //  manage the chef-client runs
-    go ciManagement("chef-client", ziStatusFeeds["chef"], cmdStatusReq["chef"],cmdStatusResp["chef"], chefClientAction, 5, *verbose)
-
-    //  manage the promote-to-ship runs
-    //   pause for 25 minutes between runs (25 * 60 = 1500 seconds)
-    go ciManagement("promote-to-ship", ziStatusFeeds["promote"], cmdStatusReq["promote"], cmdStatusResp["promote"], fetchCIArtifacts, 1500, *verbose)
-
-    //  status Server also handles quiting
+    //  ctx stops the monitor, status server and quitting on signals, runCtx
+    //  kills any commands still running once everything else has stopped
+    ctx, cancel := context.WithCancel(context.Background())
+    runCtx, kill := context.WithCancel(context.Background())
+    var wg sync.WaitGroup
+    background := func(f func(context.Context)) {
+        wg.Add(1)
+        go func(){
+            defer removePidfileOnPanic()
+            defer wg.Done()
+            f(ctx)
+        }()
+    }
+
+    startDrain = func(timeout time.Duration) {
+        background(func(ctx context.Context) {
+            drain(ctx, timeout)
+        })
+    }
+
+    //  manage the configured services and watch the link, reloading both
+    //  on SIGHUP
+    services = newServiceManager(runCtx)
+    services.apply(cfg)
+    monitor = newLinkMonitor(sources, cfg.Monitor, services)
+    background(monitor.run)
+    background(reloadOnHangup)
+
+    //  status Server also handles quiting, as do signals
     quitChan = make(chan bool)
-    go statusServer()
+    quitDone = ctx.Done()
+    listener, err := listenStatus()
+    if err != nil {
+        remove_pidfile()
+        fatal("Could not listen for status requests", "port", *healthport, "error", err)
+    }
+    background(func(ctx context.Context) {
+        statusServer(ctx, listener)
+    })
+    sigs := notifyQuitSignals()
+    background(func(ctx context.Context) {
+        quitOnSignal(ctx, sigs, *signalMode, *drainTimeout)
+    })
+
+    //  systemd hears we are ready once the status server is listening and
+    //  the link has been polled
+    background(func(ctx context.Context) {
+        superviseSystemd(ctx, monitor, services)
+    })
 
     //  block until quitting time
     quit := false
     for !quit {
         quit = <-quitChan
     }
-}
 
+    //  a signal while the services stop kills what they are still running
+    slog.Info("Shutting down")
+    cancel()
+    go forceQuitOnSignal(sigs)
+    services.stopAll()
+    kill()
+    services.waitStopped()
+    wg.Wait()
+}
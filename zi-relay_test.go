@@ -7,6 +7,10 @@ import (
     "time"
     "os"
     "fmt"
+    json "encoding/json"
+    "context"
+    "strings"
+    filepath "path/filepath"
 )
 
 var (
@@ -16,15 +20,17 @@ var (
 
 func TestStatusServer(t *testing.T) {
     quitChan = make(chan bool, 1)
-    stopZIMon = make(chan bool, 10)
-    cmdStatusReq = make(map[string] chan bool, 2)
-    cmdStatusReq["shovel"] = make(chan bool)
-    cmdStatusReq["chef"] = make(chan bool)
-
-    cmdStatusResp = make(map[string] chan bool, 2)
-    cmdStatusResp["shovel"] = make(chan bool)
-    cmdStatusResp["chef"] = make(chan bool)
-    go statusServer()
+    shutdown = &shutdownProgress{}
+    ctx, cancel := context.WithCancel(context.Background())
+    defer cancel()
+    services = newServiceManager(ctx)
+    services.services["shovel"] = newManagedService(ctx, serviceConfig{Name: "shovel"})
+    services.services["chef"] = newManagedService(ctx, serviceConfig{Name: "chef"})
+    listener, err := listenStatus()
+    if err != nil {
+        t.Fatalf("Failed to listen with %s", err)
+    }
+    go statusServer(ctx, listener)
 
     //  let the other go routine get started
     time.Sleep(1 * time.Millisecond)
@@ -40,24 +46,10 @@ func TestStatusServer(t *testing.T) {
         t.Errorf("Expected PONG, got %s", string(body))
     }
 
-    cStatus := false
-    go func(){
-        for {
-            <-cmdStatusReq["shovel"]
-            cmdStatusResp["shovel"] <- cStatus
-        }
-    }()
-
-    go func(){
-        for {
-            <-cmdStatusReq["chef"]
-            cmdStatusResp["chef"] <- cStatus
-        }
-    }()
-
     checkQuit(true, t)
 
-    cStatus = true
+    shutdown = &shutdownProgress{}
+    services.services["chef"].state.update(func(s *serviceStatus) { s.Running = true })
     checkQuit(false, t)
 
 }
@@ -73,7 +65,7 @@ func checkQuit(qExp bool, t *testing.T) {
             if q == qExp {
                 t.Log("Successfully called quit endpoint")
             } else {
-                t.Errorf("Did not get expected response from quit.  Expected %s, got %s\n", qExp, q)
+                t.Errorf("Did not get expected response from quit.  Expected %t, got %t\n", qExp, q)
             }
         case <- time.After(1 * time.Second):
             t.Error("Failed to get a message back from quit handler after 1 second")
@@ -111,6 +103,10 @@ func dummyZI(){
         dummyZILatch = true
         http.HandleFunc("/ZIOn", ziOnHandle)
         http.HandleFunc("/ZIOff", ziOffHandle)
+        http.HandleFunc("/ZIHang", ziHangHandle)
+        http.HandleFunc("/ZIBroken", ziBrokenHandle)
+        http.HandleFunc("/ZIEmpty", ziEmptyHandle)
+        http.HandleFunc("/ZIOldCase", ziOldCaseHandle)
 
         http.ListenAndServe(":7000", nil)
     }
@@ -120,55 +116,112 @@ func ziOnHandle(w http.ResponseWriter, r *http.Request){
     fmt.Fprintf(w, "{\"connObjectList\":[{\"deviceType\":\"BATS\",\"deviceName\":\"10.151.1.151\",\"connected\":false}],\"usingBATS\":true,\"secondsUntilUserCanInteract\":0,\"connectionExplanation\":\"Ship in motion\",\"userOverride\":false}")
 }
 
+//  accepts the request but never answers it
+func ziHangHandle(w http.ResponseWriter, r *http.Request){
+    select {
+    case <-r.Context().Done():
+    case <-time.After(30 * time.Second):
+    }
+}
+
+//  a server error with a json body
+func ziBrokenHandle(w http.ResponseWriter, r *http.Request){
+    w.WriteHeader(503)
+    fmt.Fprintf(w, "{\"error\":\"backend down\"}")
+}
+
+//  json, but not a connectionStatus
+func ziEmptyHandle(w http.ResponseWriter, r *http.Request){
+    fmt.Fprintf(w, "{}")
+}
+
+//  usingBats spelled the way older ZI builds did
+func ziOldCaseHandle(w http.ResponseWriter, r *http.Request){
+    fmt.Fprintf(w, "{\"connObjectList\":[],\"usingBats\":true,\"secondsUntilUserCanInteract\":0,\"connectionExplanation\":\"Ship in motion\",\"userOverride\":false}")
+}
+
 func ziOffHandle(w http.ResponseWriter, r *http.Request){
     fmt.Fprintf(w, "{\"connObjectList\":[{\"deviceType\":\"BATS\",\"deviceName\":\"10.151.1.151\",\"connected\":false}],\"usingBATS\":false,\"secondsUntilUserCanInteract\":0,\"connectionExplanation\":\"Ship in motion\",\"userOverride\":false}")
 }
 
+func TestZIStatusDecode(t *testing.T) {
+    go dummyZI()
+    time.Sleep(1 * time.Second)
+
+    resp, err := http.Get("http://localhost:7000/ZIOn")
+    if err != nil {
+        t.Fatalf("Failed to query dummy ZI with %s", err)
+    }
+    var status ziStatus
+    err = json.NewDecoder(resp.Body).Decode(&status)
+    resp.Body.Close()
+    if err != nil {
+        t.Fatalf("Failed to decode ZI status with %s", err)
+    }
+
+    if !status.UsingBats || status.ConnectionExplanation != "Ship in motion" || status.UserOverride {
+        t.Errorf("ZI status decoded incorrectly: %+v", status)
+    }
+    if len(status.ConnObjectList) != 1 || status.ConnObjectList[0].DeviceName != "10.151.1.151" {
+        t.Errorf("ZI connections decoded incorrectly: %+v", status.ConnObjectList)
+    }
+    if status.connected("BATS") {
+        t.Error("BATS device should not be connected")
+    }
+}
+
 func TestShovelStartManagement(t *testing.T){
-    rabbitProg = "./sleep-short.sh"
-    chefClient = "./sleep-long.sh"
-    testManagement("http://localhost:7000/ZIOn", "shovel", 4, 1, t)
+    testShovelManagement("http://localhost:7000/ZIOn", "running", t)
 }
 
 func TestShovelStopManagement(t *testing.T){
-    rabbitProg = "./sleep-short.sh"
-    chefClient = "./sleep-long.sh"
-    testManagement("http://localhost:7000/ZIOff", "shovel", 4, 1, t)
+    testShovelManagement("http://localhost:7000/ZIOff", "stopped", t)
 }
 
-func TestChefClientManagment(t *testing.T) {
-    rabbitProg = "./sleep-long.sh"
-    chefClient = "./sleep-short.sh"
-    testManagement("http://localhost:7000/ZIOn", "chef", 4, 3, t)
-}
+func testShovelManagement(testUri, expected string, t *testing.T) {
+    script, calls := fakeInitScript(t)
+    shovel := serviceConfig{Name: "shovel", Kind: serviceToggle, Command: []string{script}, Interval: 1, EnabledOn: []linkState{linkBATS}}
 
-func testManagement(testUri, appName string, sleepOne, sleepTwo int, t *testing.T) {
-    ziStatusFeeds := make(map[string] chan bool, 2)
-    ziStatusFeeds["shovel"] = make(chan bool, 10)
-    ziStatusFeeds["chef"] = make(chan bool, 10)
+    go dummyZI()
+    time.Sleep(1 * time.Second)
 
-    cmdStatusReq = make(map[string] chan bool, 2)
-    cmdStatusReq["shovel"] = make(chan bool)
-    cmdStatusReq["chef"] = make(chan bool)
+    ctx, cancel := context.WithCancel(context.Background())
+    defer cancel()
+    feeds := newServiceManager(ctx)
+    sources := []LinkSource{&ziSource{name: sourceZI, uri: testUri}}
+    go newLinkMonitor(sources, monitorConfig{Interval: 5}, feeds).run(ctx)
+    feeds.apply(&relayConfig{Services: []serviceConfig{shovel}})
+    defer feeds.stopAll()
+
+    time.Sleep(2 * time.Second)
+    if status := feeds.statuses()[0]; len(status.Shovels) == 1 && status.Shovels[0].State == expected {
+        t.Log("shovel is " + expected + " as expected after " + calls())
+    } else {
+        t.Errorf("shovel should be %s, got %+v after %s", expected, status, calls())
+    }
+}
 
-    cmdStatusResp = make(map[string] chan bool, 2)
-    cmdStatusResp["shovel"] = make(chan bool)
-    cmdStatusResp["chef"] = make(chan bool)
+func TestChefClientManagment(t *testing.T) {
+    testManagement("http://localhost:7000/ZIOn", "chef-sleep-client", "./sleep-long.sh", "./sleep-short.sh", 4, 3, t)
+}
 
-    stopZIMon = make(chan bool, 1)
+func testManagement(testUri, appName, rabbitProg, chefClient string, sleepOne, sleepTwo int, t *testing.T) {
+    shovel := serviceConfig{Name: "shovel", Kind: serviceToggle, Command: []string{rabbitProg}, Interval: 2, EnabledOn: []linkState{linkBATS}}
+    chef := serviceConfig{Name: "chef-sleep-client", Kind: serviceCI, Command: []string{chefClient}, Interval: 2, EnabledOn: []linkState{linkBATS}}
 
     go dummyZI()
     time.Sleep(1 * time.Second)
 
-    go zeroImpactMonitor(&testUri, ziStatusFeeds, true)
-    go shovelManagement(ziStatusFeeds["shovel"], cmdStatusReq["shovel"], cmdStatusResp["shovel"], 2, true)
-    go ciManagement("chef-sleep-client", ziStatusFeeds["chef"], cmdStatusReq["chef"], cmdStatusResp["chef"], chefClientAction, 2, true)
+    ctx, cancel := context.WithCancel(context.Background())
+    feeds := newServiceManager(ctx)
+    sources := []LinkSource{&ziSource{name: sourceZI, uri: testUri}}
+    go newLinkMonitor(sources, monitorConfig{Interval: 5}, feeds).run(ctx)
+    feeds.apply(&relayConfig{Services: []serviceConfig{shovel, chef}})
 
     //  lets all go routines start
     time.Sleep(time.Duration(sleepOne) * time.Second)
 
-    cmdStatusReq[appName] <- true
-    appNameStatus := <-cmdStatusResp[appName]
+    appNameStatus := feeds.services[appName].running()
 
     if appNameStatus {
         t.Log(appName + " command is running as expected")
@@ -180,8 +233,7 @@ func testManagement(testUri, appName string, sleepOne, sleepTwo int, t *testing.
     time.Sleep(time.Duration(sleepTwo) * time.Second)
 
     //  shove a sleep in to make sure we don't grab our own message
-    cmdStatusReq[appName] <- true
-    appNameStatus = <-cmdStatusResp[appName]
+    appNameStatus = feeds.services[appName].running()
 
     if !appNameStatus {
         t.Log(appName + " command is not running as expected")
@@ -189,8 +241,76 @@ func testManagement(testUri, appName string, sleepOne, sleepTwo int, t *testing.
         t.Error(appName + " command is reporting it is running.  It should not be")
     }
 
-    stopZIMon <- false
-    ziStatusFeeds = nil
-    cmdStatusReq = nil
-    cmdStatusResp = nil
+    feeds.stopAll()
+    cancel()
+}
+
+func TestCommandActionCancelled(t *testing.T) {
+    ctx, cancel := context.WithTimeout(context.Background(), 500 * time.Millisecond)
+    defer cancel()
+
+    start := time.Now()
+    err := commandAction("sleeper", []string{"./sleep-long.sh"}, time.Second)(ctx, ioutil.Discard)
+    if err == nil {
+        t.Error("A cancelled command should fail")
+    } else if time.Since(start) > 3 * time.Second {
+        t.Errorf("Cancelled command took %s to return", time.Since(start))
+    }
+}
+
+func TestRunCommandKillsGroup(t *testing.T) {
+    ctx, cancel := context.WithTimeout(context.Background(), 300 * time.Millisecond)
+    defer cancel()
+
+    //  the shell ignores SIGTERM, only SIGKILL stops it
+    start := time.Now()
+    err := runCommand(ctx, []string{"sh", "-c", "trap '' TERM; while true; do sleep 0.1; done"}, ioutil.Discard, 500 * time.Millisecond)
+    if err == nil {
+        t.Error("A killed command should fail")
+    } else if elapsed := time.Since(start); elapsed < 800 * time.Millisecond || elapsed > 3 * time.Second {
+        t.Errorf("Expected SIGKILL after the grace period, took %s", elapsed)
+    }
+}
+
+func TestServiceTimeout(t *testing.T) {
+    ctx, cancel := context.WithCancel(context.Background())
+    defer cancel()
+    feeds := newServiceManager(ctx)
+    feeds.publish(linkStatus{State: linkBATS})
+    feeds.apply(&relayConfig{Services: []serviceConfig{
+        {Name: "hung", Kind: serviceCI, Command: []string{"./sleep-long.sh"}, Interval: 1, Timeout: 1, KillGrace: 1, EnabledOn: []linkState{linkBATS}},
+    }})
+    defer feeds.stopAll()
+    time.Sleep(3 * time.Second)
+
+    runs := feeds.history("hung", false).list()
+    if len(runs) < 2 {
+        t.Fatalf("The service should carry on after a timeout, got runs %+v", runs)
+    }
+    if last := runs[len(runs) - 1]; !last.TimedOut || last.Finished.Sub(last.Started) > 2 * time.Second {
+        t.Errorf("First run should have timed out after a second, got %+v", last)
+    }
+}
+
+func TestRunCommandKillsOrphans(t *testing.T) {
+    ctx, cancel := context.WithTimeout(context.Background(), 300 * time.Millisecond)
+    defer cancel()
+
+    //  a grandchild that ignores SIGTERM, outlives the shell and doesn't
+    //  hold its output
+    pidfile := filepath.Join(t.TempDir(), "orphan")
+    err := runCommand(ctx, []string{"sh", "-c", "(trap '' TERM; exec sleep 37) >/dev/null 2>&1 & echo $! > " + pidfile + "; sleep 30"}, ioutil.Discard, 500 * time.Millisecond)
+    if err == nil {
+        t.Error("A cancelled command should fail")
+    }
+    pid, err := ioutil.ReadFile(pidfile)
+    if err != nil {
+        t.Fatalf("Grandchild never started: %s", err)
+    }
+
+    time.Sleep(time.Second)
+    stat, err := ioutil.ReadFile("/proc/" + strings.TrimSpace(string(pid)) + "/stat")
+    if err == nil && !strings.Contains(string(stat), ") Z ") {
+        t.Errorf("Expected the grandchild killed with its group after the grace period, still running: %s", stat)
+    }
 }